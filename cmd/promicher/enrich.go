@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"github.com/flant/promicher/pkg/kube"
+	"github.com/flant/promicher/pkg/promicher"
+	"github.com/romana/rlog"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+var (
+	EnrichCommand = App.Command("enrich", `Enrich alerts offline: read alerts JSON payload from the file or stdin,
+enrich it using the current kubeconfig, print enriched JSON to stdout and the diff to stderr.`)
+
+	EnrichFile = EnrichCommand.
+			Arg("file", "File with alerts JSON payload, - for stdin.").
+			Default("-").
+			String()
+
+	EnrichAPIVersion = EnrichCommand.
+				Flag("api-version", "Alertmanager API version of the payload: v1 or v2.").
+				Default("v1").
+				Enum(string(promicher.APIv1), string(promicher.APIv2))
+
+	EnrichSyncTimeout = EnrichCommand.
+				Flag("sync-timeout", "How long to wait for kube informers caches to be filled.").
+				Default("1m").
+				Duration()
+)
+
+// Enrich runs the enrich command and returns the exit code.
+func Enrich() int {
+	var dataBytes []byte
+	var err error
+
+	if *EnrichFile == "-" {
+		dataBytes, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		dataBytes, err = ioutil.ReadFile(*EnrichFile)
+	}
+	if err != nil {
+		rlog.Criticalf("Cannot read alerts: %s", err)
+		return 1
+	}
+
+	version := promicher.APIVersion(*EnrichAPIVersion)
+
+	alerts, err := promicher.ParseAlerts(dataBytes, version)
+	if err != nil {
+		rlog.Criticalf("Cannot parse API %s alerts: %s", version, err)
+		return 1
+	}
+
+	config, err := LoadConfig()
+	if err != nil {
+		rlog.Criticalf("Cannot load config: %s", err)
+		return 1
+	}
+
+	kube, err := kube.NewKube()
+	if err != nil {
+		rlog.Criticalf("Cannot initialize kube: %s", err)
+		return 1
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	kube.Start(stopCh)
+
+	syncStopCh := make(chan struct{})
+	timer := time.AfterFunc(*EnrichSyncTimeout, func() { close(syncStopCh) })
+	synced := kube.WaitForCacheSync(syncStopCh)
+	timer.Stop()
+	if !synced {
+		rlog.Criticalf("Kube informers caches are not synced in %s", *EnrichSyncTimeout)
+		return 1
+	}
+
+	enricher := promicher.NewPromicher(kube, promicher.NewLRUAlertsCache(len(alerts), 0), config)
+	enricher.MaxOwnerDepth = *MaxOwnerDepth
+	enricher.OwnerChainAnnotation = *OwnerChainAnnotation
+	enricher.StatusAnnotation = *StatusAnnotation
+	enricher.ErrorPolicy = promicher.ErrorPolicy(*OnEnrichmentError)
+	enricher.FailedAlertPolicy = promicher.FailedAlertPolicy(*OnFailedAlert)
+
+	newAlerts, failed, err := enricher.ProcessAlerts(alerts)
+	if err != nil {
+		rlog.Criticalf("Cannot enrich alerts: %s", err)
+		return 1
+	}
+
+	newDataBytes, err := promicher.DumpAlerts(newAlerts, version)
+	if err != nil {
+		rlog.Criticalf("Cannot dump enriched alerts: %s", err)
+		return 1
+	}
+
+	fmt.Fprintln(os.Stdout, string(newDataBytes))
+	fmt.Fprintln(os.Stderr, promicher.DiffAlerts(alerts, newAlerts))
+
+	// Failed alerts fail the command, so CI catches broken rules
+	if failed > 0 {
+		rlog.Errorf("%d of %d alerts failed to enrich", failed, len(alerts))
+		return 1
+	}
+
+	return 0
+}
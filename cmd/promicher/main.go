@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"github.com/flant/promicher/pkg/kube"
+	"github.com/flant/promicher/pkg/metrics"
 	"github.com/flant/promicher/pkg/promicher"
 	"github.com/flant/promicher/pkg/server"
 	"github.com/romana/rlog"
@@ -10,17 +12,26 @@ import (
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
+)
+
+const (
+	DefaultDestinationUrl = "http://localhost:8000/api/v1/alerts"
 )
 
 var (
 	App = kingpin.New(filepath.Base(os.Args[0]), "The Promicher: Prometheus alerts enricher")
 
+	ServeCommand = App.Command("serve", "Run the enriching proxy between Prometheus and Alertmanager.").Default()
+
 	Labels = App.
 		Flag("labels", `Pattern to select labels from kubernetes resources by keys.
 May be passed several times, all labels of kubernetes resource will be checked agains
 each of the labels patterns. Pattern is a regular expression.
 If regular expression groups are specified in the pattern,
-then the last matched group will be used as result label key.
+then the group named "key" or the last matched group will be used as result label key.
+The result key may be set explicitly with the template after "=>":
+$1 and ${name} in the template are replaced with the matched groups.
 For example label {"monitoring.somehost.io/tier": "some-value"}
 match agains pattern "monitoring.somehost.io/(tier)" will result
 in prometheus label named {"tier": "some-value"}.
@@ -31,6 +42,10 @@ Examples:
 
 {"some.host.io/path": "value"} pattern "(.*)/(path)" => {"path": "value"} (using the last matched group)
 
+{"some.host.io/path": "value"} pattern "(?P<key>.*)/path" => {"some.host.io": "value"} (using the "key" group)
+
+{"some.host.io/path": "value"} pattern "(?P<host>[a-z]+)\..*/(path)=>${host}_${2}" => {"some_path": "value"}
+
 {"some.host.io/path": "value"} pattern "some.host.io" -> NO MATCH
 
 {"some.host.io/path": "value"} pattern "some.host.io/.*" -> {"some.host.io/path": "value"}`).
@@ -42,10 +57,78 @@ May be passed several times, all annotations of kubernetes resource will be chec
 each of the annotations patterns. The format is the same as labels.`).
 			Strings()
 
+	MergePolicy = App.
+			Flag("merge-policy", `Which value wins when the alert and kubernetes objects have different values
+of a key selected by --labels and --annotations patterns: alert-wins, resource-wins,
+nearest-wins, farthest-wins or error-on-conflict. See README for details.`).
+			Default(string(promicher.DefaultMergePolicy)).
+			Enum(string(promicher.AlertWins), string(promicher.ResourceWins), string(promicher.NearestWins),
+			string(promicher.FarthestWins), string(promicher.ErrorOnConflict))
+
+	KeyPrefix = App.
+			Flag("key-prefix", "Prefix of keys selected by --labels and --annotations patterns.").
+			String()
+
+	MaxOwnerDepth = App.
+			Flag("max-owner-depth", "How many owner references to follow from the alert target object, 0 disables owners.").
+			Default("10").
+			Int()
+
+	TombstoneRetention = App.
+				Flag("tombstone-retention", `How long to keep metadata of deleted kubernetes objects to enrich alerts
+about already deleted pods and finished jobs, 0 disables tombstones.`).
+				Default("30m").
+				Duration()
+
+	OwnerChainAnnotation = App.
+				Flag("owner-chain-annotation", `Alert annotation to write the owner chain of the alert target object to,
+e.g. kube_owner_chain="Deployment/api > ReplicaSet/api-7d > Pod/api-7d-x". Disabled when empty.`).
+				String()
+
+	StatusAnnotation = App.
+				Flag("status-annotation", `Alert annotation to write the enrichment status to, e.g.
+promicher_status="partial: forbidden on namespace/shop". Disabled when empty.`).
+				String()
+
+	OnEnrichmentError = App.
+				Flag("on-enrichment-error", `What to do when kubernetes objects of an alert cannot be loaded for other
+reasons than not found: forward the alert with whatever data could be loaded or fail the batch.`).
+				Default(string(promicher.ForwardUnenriched)).
+				Enum(string(promicher.ForwardUnenriched), string(promicher.FailBatch))
+
+	OnFailedAlert = App.
+			Flag("on-failed-alert", `What to do with an alert which fails to enrich, e.g. because of a merge conflict:
+forward it unchanged or drop it. Other alerts of the batch are forwarded anyway.`).
+			Default(string(promicher.ForwardFailedAlert)).
+			Enum(string(promicher.ForwardFailedAlert), string(promicher.DropFailedAlert))
+
+	ConfigPath = App.
+			Flag("config", `Path to the YAML file with enrichment rules and alert targets, see README for the format.
+Rules from the file take precedence over --labels and --annotations patterns.
+The file is reloaded on SIGHUP and on change.`).
+			String()
+
+	ConfigCheckInterval = App.
+				Flag("config-check-interval", "How often to check the rules file for changes.").
+				Default("10s").
+				Duration()
+
 	EvaluationInterval = App.
 				Flag("evaluation-interval", "Prometheus evaluation interval.").
 				Default("30s").
-				String()
+				Duration()
+
+	AlertsCacheSize = App.
+			Flag("alerts-cache-size", "Maximum number of enriched alerts kept in the cache, least recently used alerts are evicted.").
+			Default("10000").
+			Int()
+
+	AlertsCacheTTLIntervals = App.
+				Flag("alerts-cache-ttl-intervals", `Enriched alerts cache entry TTL in number of evaluation intervals.
+The TTL, the intervals count times --evaluation-interval, should exceed 15m for which Prometheus
+keeps sending resolved alerts.`).
+				Default("40").
+				Int()
 
 	Listen = App.
 		Flag("listen", "Listen on the specified address for incoming requests.").
@@ -53,29 +136,181 @@ each of the annotations patterns. The format is the same as labels.`).
 		String()
 
 	DestinationUrl = App.
-			Flag("destination-url", "Proxy enriched requests to the specified address.").
-			Default("http://localhost:8000/api/v1/alerts").
+			Flag("destination-url", `Proxy enriched requests to the specified address.
+May be passed several times, enriched alerts are sent to all destinations concurrently.
+Alertmanager API version of the destination may be set with v1= or v2= prefix,
+for example "v2=http://alertmanager:9093/api/v2/alerts", otherwise
+it is detected from the URL path: /api/v2/alerts is v2, anything else is v1.
+Alerts received on /api/v1/alerts and /api/v2/alerts are converted to the destination API version.
+Default is `+DefaultDestinationUrl+` when neither urls nor services are specified.`).
+			Strings()
+
+	DestinationServices = App.
+				Flag("destination-service", `Proxy enriched requests to all ready endpoints of the kubernetes Service.
+The format is [v1=|v2=]namespace/name[:port], where port is a name or a number
+of the endpoints port and may be omitted if endpoints have a single port.
+Endpoints are requested at the Alertmanager API path of the specified version, v1 by default.
+May be passed several times.`).
+				Strings()
+
+	DestinationPolicy = App.
+				Flag("destination-policy", `Which destinations should accept alerts for the request to be successful:
+any, all or quorum (more than half of destinations).`).
+				Default("any").
+				Enum(string(server.PolicyAny), string(server.PolicyAll), string(server.PolicyQuorum))
+
+	DestinationTimeout = App.
+				Flag("destination-timeout", "Timeout of a request to a destination.").
+				Default("10s").
+				Duration()
+
+	ShutdownDelay = App.
+			Flag("shutdown-delay", `On SIGTERM /readyz reports not ready at once and requests are still served
+during the delay, so that kubernetes stops routing Prometheus to the pod.`).
+			Default("5s").
+			Duration()
+
+	ShutdownTimeout = App.
+			Flag("shutdown-timeout", `Maximum time for the graceful shutdown including the delay:
+in-flight alerts requests are drained and queued retries are flushed.`).
+			Default("30s").
+			Duration()
+
+	RetryQueueSize = App.
+			Flag("retry-queue-size", `Maximum number of failed alerts batches queued for retry, the oldest batches are dropped when the queue is full.
+Batches for a destination service without ready endpoints are queued too. 0 disables retries.`).
+			Default("1000").
+			Int()
+
+	RetryMaxAge = App.
+			Flag("retry-max-age", "Failed alerts batch is dropped from the retry queue when it is older than the specified age.").
+			Default("15m").
+			Duration()
+
+	RetryInitialBackoff = App.
+				Flag("retry-initial-backoff", "Delay before the first retry, the delay is doubled on every next attempt.").
+				Default("1s").
+				Duration()
+
+	RetryMaxBackoff = App.
+			Flag("retry-max-backoff", "Maximum delay between retries, 0 means 1h.").
+			Default("1m").
+			Duration()
+
+	RetryQueueDir = App.
+			Flag("retry-queue-dir", `Store the retry queue in the specified directory to keep failed alerts batches across restarts,
+at most --retry-queue-size batches are loaded. Files contain request headers and are readable by the owner only.
+In-memory only by default.`).
+			String()
+
+	AlertsCacheFile = App.
+			Flag("alerts-cache-file", `Store snapshots of the enriched alerts cache in the specified JSON file and load it on start,
+so alerts keep their enrichment across restarts. In-memory only by default.`).
 			String()
+
+	AlertsCacheSnapshotInterval = App.
+					Flag("alerts-cache-snapshot-interval", "How often to save the alerts cache snapshot to --alerts-cache-file.").
+					Default("1m").
+					Duration()
 )
 
-func WaitForExitCode() int {
+func WaitForExitCode(onReload func()) int {
 	interruptCh := make(chan os.Signal, 1)
-	signal.Notify(interruptCh, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(interruptCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	for {
 		select {
 		case sig := <-interruptCh:
+			if sig == syscall.SIGHUP {
+				rlog.Infof("Reload with %s signal", sig.String())
+				onReload()
+				continue
+			}
+
 			rlog.Infof("Grace shutdown with %s signal", sig.String())
 			return 0
 		}
 	}
 }
 
+// LoadConfig makes enrichment config from the rules file and --labels, --annotations patterns.
+func LoadConfig() (*promicher.Config, error) {
+	config := &promicher.Config{Targets: promicher.DefaultTargets}
+
+	if *ConfigPath != "" {
+		var err error
+		config, err = promicher.LoadConfig(*ConfigPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	patternsRules, err := promicher.NewPatternsRules(*Labels, *Annotations, promicher.MergePolicy(*MergePolicy), *KeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	config.Rules = append(config.Rules, patternsRules...)
+
+	return config, nil
+}
+
 func main() {
 	App.HelpFlag.Short('h')
 
 	App.Version("0.1.0")
 
-	kingpin.MustParse(App.Parse(os.Args[1:]))
+	command := kingpin.MustParse(App.Parse(os.Args[1:]))
+
+	if _, err := promicher.CompilePatterns(*Labels); err != nil {
+		rlog.Criticalf("Bad --labels: %s", err)
+		os.Exit(1)
+	}
+	if _, err := promicher.CompilePatterns(*Annotations); err != nil {
+		rlog.Criticalf("Bad --annotations: %s", err)
+		os.Exit(1)
+	}
+
+	switch command {
+	case EnrichCommand.FullCommand():
+		os.Exit(Enrich())
+	}
+
+	var destinations []*server.Destination
+	var serviceDestinations []*server.ServiceDestination
+
+	for _, spec := range *DestinationServices {
+		serviceDestination, err := server.ParseServiceDestination(spec)
+		if err != nil {
+			rlog.Criticalf("Bad --destination-service: %s", err)
+			os.Exit(1)
+		}
+		serviceDestinations = append(serviceDestinations, serviceDestination)
+	}
+
+	destinationUrls := *DestinationUrl
+	if len(destinationUrls) == 0 && len(serviceDestinations) == 0 {
+		destinationUrls = []string{DefaultDestinationUrl}
+	}
+
+	for _, spec := range destinationUrls {
+		destination, err := server.ParseDestination(spec)
+		if err != nil {
+			rlog.Criticalf("Bad --destination-url: %s", err)
+			os.Exit(1)
+		}
+		destinations = append(destinations, destination)
+	}
+
+	policy, err := server.ParseSuccessPolicy(*DestinationPolicy)
+	if err != nil {
+		rlog.Criticalf("Bad --destination-policy: %s", err)
+		os.Exit(1)
+	}
+
+	config, err := LoadConfig()
+	if err != nil {
+		rlog.Criticalf("Cannot load config: %s", err)
+		os.Exit(1)
+	}
 
 	kube, err := kube.NewKube()
 	if err != nil {
@@ -83,8 +318,94 @@ func main() {
 		os.Exit(1)
 	}
 
-	promicher := promicher.NewPromicher(kube, *Labels, *Annotations)
-	srv := server.NewServer(*Listen, *DestinationUrl, promicher)
+	if len(serviceDestinations) > 0 {
+		kube.AddInformer(kube.Informers.Core().V1().Endpoints().Informer())
+	}
+
+	if *TombstoneRetention > 0 {
+		kube.EnableTombstones(*TombstoneRetention)
+		metrics.RegisterGaugeFunc("kube_tombstones", "Deleted kubernetes objects kept for enrichment, including expired ones not dropped yet.", func() float64 {
+			return float64(kube.Tombstones.Len())
+		})
+	}
+
+	stopCh := make(chan struct{})
+
+	kube.Start(stopCh)
+	go func() {
+		if kube.WaitForCacheSync(stopCh) {
+			rlog.Info("Kube: informers caches synced")
+		}
+	}()
+
+	alertsCacheTTL := time.Duration(*AlertsCacheTTLIntervals) * *EvaluationInterval
+	alertsCache := promicher.NewLRUAlertsCache(*AlertsCacheSize, alertsCacheTTL)
+	rlog.Infof("Alerts cache: max %d entries, ttl %s", *AlertsCacheSize, alertsCacheTTL)
+
+	var alertsCacheStore *promicher.AlertsCacheStore
+	if *AlertsCacheFile != "" {
+		alertsCacheStore = promicher.NewAlertsCacheStore(*AlertsCacheFile, alertsCache)
+		// A broken snapshot should not prevent alerts from being forwarded
+		if err := alertsCacheStore.Load(); err != nil {
+			rlog.Errorf("Alerts cache: %s", err)
+		}
+		go alertsCacheStore.Run(*AlertsCacheSnapshotInterval, stopCh)
+	}
+
+	enricher := promicher.NewPromicher(kube, alertsCache, config)
+	enricher.MaxOwnerDepth = *MaxOwnerDepth
+	enricher.OwnerChainAnnotation = *OwnerChainAnnotation
+	enricher.StatusAnnotation = *StatusAnnotation
+	enricher.ErrorPolicy = promicher.ErrorPolicy(*OnEnrichmentError)
+	enricher.FailedAlertPolicy = promicher.FailedAlertPolicy(*OnFailedAlert)
+
+	metrics.RegisterCounterFunc("alerts_cache_hits_total", "Alerts cache hits.", func() float64 {
+		return float64(alertsCache.Stats().Hits)
+	})
+	metrics.RegisterCounterFunc("alerts_cache_misses_total", "Alerts cache misses.", func() float64 {
+		return float64(alertsCache.Stats().Misses)
+	})
+	metrics.RegisterCounterFunc("alerts_cache_evictions_total", "Alerts cache least recently used entries evictions.", func() float64 {
+		return float64(alertsCache.Stats().Evictions)
+	})
+	metrics.RegisterCounterFunc("alerts_cache_expirations_total", "Alerts cache entries removed after TTL.", func() float64 {
+		return float64(alertsCache.Stats().Expirations)
+	})
+	metrics.RegisterGaugeFunc("alerts_cache_entries", "Alerts cache entries count.", func() float64 {
+		return float64(alertsCache.Stats().Entries)
+	})
+
+	reloadConfig := func() {
+		config, err := LoadConfig()
+		if err != nil {
+			rlog.Errorf("Cannot reload config, keeping the previous config: %s", err)
+			return
+		}
+		enricher.SetConfig(config)
+		rlog.Infof("Config reloaded: %d rules, %d targets", len(config.Rules), len(config.Targets))
+	}
+
+	if *ConfigPath != "" {
+		go promicher.WatchConfigFile(*ConfigPath, *ConfigCheckInterval, stopCh, reloadConfig)
+	}
+
+	forwarder := server.NewForwarder(destinations, serviceDestinations, policy, *DestinationTimeout, kube)
+
+	var retryQueue *server.RetryQueue
+	if *RetryQueueSize > 0 {
+		retryQueue, err = server.NewRetryQueue(forwarder, *RetryQueueSize, *RetryMaxAge, *RetryInitialBackoff, *RetryMaxBackoff, *RetryQueueDir)
+		if err != nil {
+			rlog.Criticalf("Cannot initialize retry queue: %s", err)
+			os.Exit(1)
+		}
+		go retryQueue.Run(stopCh)
+
+		metrics.RegisterGaugeFunc("retry_queue_batches", "Failed alerts batches waiting for retry.", func() float64 {
+			return float64(retryQueue.Len())
+		})
+	}
+
+	srv := server.NewServer(*Listen, forwarder, retryQueue, enricher)
 
 	go func() {
 		err := srv.Run()
@@ -94,5 +415,23 @@ func main() {
 		}
 	}()
 
-	os.Exit(WaitForExitCode())
+	exitCode := WaitForExitCode(reloadConfig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *ShutdownTimeout)
+	if err := srv.Shutdown(ctx, *ShutdownDelay); err != nil {
+		rlog.Errorf("Server graceful shutdown failed: %s", err)
+	}
+	if retryQueue != nil {
+		retryQueue.Flush(ctx)
+	}
+	cancel()
+
+	if alertsCacheStore != nil {
+		if err := alertsCacheStore.Save(); err != nil {
+			rlog.Errorf("Alerts cache: %s", err)
+		}
+	}
+
+	close(stopCh)
+	os.Exit(exitCode)
 }
@@ -0,0 +1,71 @@
+package fake
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Names of objects of the cluster made by NewCluster.
+const (
+	ClusterNamespace  = "shop"
+	ClusterDeployment = "web"
+	ClusterReplicaSet = "web-5d8f"
+	ClusterPod        = "web-5d8f-x7k2"
+	ClusterCronJob    = "backup"
+	ClusterJob        = "backup-27000"
+	ClusterJobPod     = "backup-27000-q9z"
+	ClusterPVC        = "data"
+	ClusterNode       = "worker-1"
+	ClusterNodeIP     = "10.0.1.5"
+	ClusterPV         = "pvc-7f3a"
+)
+
+// NewCluster makes objects of the typical cluster:
+// Namespace, Deployment -> ReplicaSet -> Pod, CronJob -> Job -> Pod, PersistentVolumeClaim,
+// and cluster-scoped PersistentVolume and Node.
+// Every object has the "level" label and annotation with its own value
+// to check which object wins on merge.
+func NewCluster() []*unstructured.Unstructured {
+	namespace := WithMetadata(NewObject("Namespace", "", ClusterNamespace),
+		map[string]string{"level": "namespace", "team": "shop-team"},
+		map[string]string{"level": "namespace", "owner": "shop@example.com"})
+
+	deployment := WithMetadata(NewObject("Deployment", ClusterNamespace, ClusterDeployment),
+		map[string]string{"level": "deployment", "app": "web"},
+		map[string]string{"level": "deployment", "runbook": "https://runbooks/web"})
+	replicaSet := OwnedBy(WithMetadata(NewObject("ReplicaSet", ClusterNamespace, ClusterReplicaSet),
+		map[string]string{"level": "replicaset", "app": "web", "pod-template-hash": "5d8f"},
+		nil), deployment)
+	pod := OwnedBy(WithMetadata(NewObject("Pod", ClusterNamespace, ClusterPod),
+		map[string]string{"level": "pod", "app": "web", "pod-template-hash": "5d8f"},
+		map[string]string{"level": "pod"}), replicaSet)
+
+	cronJob := WithMetadata(NewObject("CronJob", ClusterNamespace, ClusterCronJob),
+		map[string]string{"level": "cronjob", "app": "backup"},
+		map[string]string{"level": "cronjob", "runbook": "https://runbooks/backup"})
+	job := OwnedBy(WithMetadata(NewObject("Job", ClusterNamespace, ClusterJob),
+		map[string]string{"level": "job", "app": "backup"},
+		nil), cronJob)
+	jobPod := OwnedBy(WithMetadata(NewObject("Pod", ClusterNamespace, ClusterJobPod),
+		map[string]string{"level": "pod", "app": "backup"},
+		nil), job)
+
+	pvc := WithMetadata(NewObject("PersistentVolumeClaim", ClusterNamespace, ClusterPVC),
+		map[string]string{"level": "pvc", "app": "web"},
+		map[string]string{"level": "pvc"})
+
+	node := WithMetadata(NewObject("Node", "", ClusterNode),
+		map[string]string{"level": "node", "topology.kubernetes.io/zone": "zone-a"},
+		map[string]string{"level": "node"})
+	node.Object["status"] = map[string]interface{}{
+		"addresses": []interface{}{
+			map[string]interface{}{"type": "InternalIP", "address": ClusterNodeIP},
+			map[string]interface{}{"type": "Hostname", "address": ClusterNode},
+		},
+	}
+
+	pv := WithMetadata(NewObject("PersistentVolume", "", ClusterPV),
+		map[string]string{"level": "pv", "storage-tier": "ssd"},
+		map[string]string{"level": "pv"})
+
+	return []*unstructured.Unstructured{namespace, deployment, replicaSet, pod, cronJob, job, jobPod, pvc, pv, node}
+}
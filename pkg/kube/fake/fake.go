@@ -0,0 +1,253 @@
+// Package fake builds a fake kubernetes cluster for tests: Kube with fake clients and object fixtures.
+package fake
+
+import (
+	"fmt"
+	"github.com/flant/promicher/pkg/kube"
+	"k8s.io/apimachinery/pkg/api/meta"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubernetesfake "k8s.io/client-go/kubernetes/fake"
+	metadatafake "k8s.io/client-go/metadata/fake"
+	kubetesting "k8s.io/client-go/testing"
+	"strings"
+	"time"
+)
+
+// Kind is a kind known to the fake cluster.
+type Kind struct {
+	GroupVersionKind schema.GroupVersionKind
+	Resource         string
+	Namespaced       bool
+}
+
+// Kinds are kinds known to the fake cluster: kube.DefaultInformerKinds, default targets kinds
+// and Rollout custom resource, which informer is started on the first request.
+var Kinds = []Kind{
+	{schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, "namespaces", false},
+	{schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, "pods", true},
+	{schema.GroupVersionKind{Version: "v1", Kind: "PersistentVolumeClaim"}, "persistentvolumeclaims", true},
+	{schema.GroupVersionKind{Version: "v1", Kind: "PersistentVolume"}, "persistentvolumes", false},
+	{schema.GroupVersionKind{Version: "v1", Kind: "Node"}, "nodes", false},
+	{schema.GroupVersionKind{Version: "v1", Kind: "Endpoints"}, "endpoints", true},
+	{schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "ReplicaSet"}, "replicasets", true},
+	{schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, "deployments", true},
+	{schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "StatefulSet"}, "statefulsets", true},
+	{schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "DaemonSet"}, "daemonsets", true},
+	{schema.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"}, "jobs", true},
+	{schema.GroupVersionKind{Group: "batch", Version: "v1", Kind: "CronJob"}, "cronjobs", true},
+	{schema.GroupVersionKind{Group: "storage.k8s.io", Version: "v1", Kind: "StorageClass"}, "storageclasses", false},
+	{schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout"}, "rollouts", true},
+}
+
+// Options of Kube of the fake cluster.
+type Options struct {
+	// Failures make matching requests fail.
+	Failures []Failure
+	// TombstoneRetention enables tombstones of deleted objects when positive.
+	TombstoneRetention time.Duration
+}
+
+// Failure makes requests of the verb to the resource of the fake cluster fail with the error,
+// e.g. forbidden "list" of "rollouts".
+type Failure struct {
+	Verb     string
+	Resource string
+	Err      error
+}
+
+// NewMapper makes the RESTMapper of Kinds.
+func NewMapper() meta.RESTMapper {
+	var groupVersions []schema.GroupVersion
+	for _, kind := range Kinds {
+		groupVersions = append(groupVersions, kind.GroupVersionKind.GroupVersion())
+	}
+
+	mapper := meta.NewDefaultRESTMapper(groupVersions)
+	for _, kind := range Kinds {
+		scope := meta.RESTScopeRoot
+		if kind.Namespaced {
+			scope = meta.RESTScopeNamespace
+		}
+		mapper.AddSpecific(
+			kind.GroupVersionKind,
+			kind.GroupVersionKind.GroupVersion().WithResource(kind.Resource),
+			kind.GroupVersionKind.GroupVersion().WithResource(strings.ToLower(kind.GroupVersionKind.Kind)),
+			scope,
+		)
+	}
+	return mapper
+}
+
+// NewKube makes Kube of the fake cluster with the objects and starts its informers.
+// Informers are stopped when stopCh is closed.
+func NewKube(stopCh <-chan struct{}, objects ...*unstructured.Unstructured) (*kube.Kube, error) {
+	return NewKubeWithOptions(stopCh, Options{}, objects...)
+}
+
+// NewKubeWithOptions makes Kube of the fake cluster like NewKube with the options.
+// Failures of resources of kube.DefaultInformerKinds make NewKubeWithOptions fail: their informers never sync.
+func NewKubeWithOptions(stopCh <-chan struct{}, options Options, objects ...*unstructured.Unstructured) (*kube.Kube, error) {
+	listKinds := make(map[schema.GroupVersionResource]string)
+	for _, kind := range Kinds {
+		listKinds[kind.GroupVersionKind.GroupVersion().WithResource(kind.Resource)] = kind.GroupVersionKind.Kind + "List"
+	}
+
+	runtimeObjects := make([]runtime.Object, 0, len(objects))
+	for _, obj := range objects {
+		runtimeObjects = append(runtimeObjects, obj.DeepCopy())
+	}
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, runtimeObjects...)
+
+	metadataClient, err := newMetadataClient(objects)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, failure := range options.Failures {
+		err := failure.Err
+		reaction := func(kubetesting.Action) (bool, runtime.Object, error) {
+			return true, nil, err
+		}
+		dynamicClient.PrependReactor(failure.Verb, failure.Resource, reaction)
+		metadataClient.PrependReactor(failure.Verb, failure.Resource, reaction)
+	}
+
+	res := kube.NewKubeWithClients(kubernetesfake.NewSimpleClientset(), dynamicClient, metadataClient, NewMapper())
+	if options.TombstoneRetention > 0 {
+		res.EnableTombstones(options.TombstoneRetention)
+	}
+	res.Start(stopCh)
+
+	syncStopCh := make(chan struct{})
+	timer := time.AfterFunc(kube.InformerSyncTimeout, func() { close(syncStopCh) })
+	defer timer.Stop()
+	if !res.WaitForCacheSync(syncStopCh) {
+		return nil, fmt.Errorf("fake kube informers caches are not synced")
+	}
+
+	return res, nil
+}
+
+// metadataClient is the fake metadata client which serves metadata of the objects of the tracker.
+type metadataClient struct {
+	*metadatafake.FakeMetadataClient
+	tracker kubetesting.ObjectTracker
+}
+
+func newMetadataClient(objects []*unstructured.Unstructured) (*metadataClient, error) {
+	// The fake client registers its list kind in the scheme
+	scheme := runtime.NewScheme()
+	client := &metadataClient{FakeMetadataClient: metadatafake.NewSimpleMetadataClient(scheme)}
+	client.tracker = kubetesting.NewObjectTracker(scheme, serializer.NewCodecFactory(scheme).UniversalDeserializer())
+
+	for _, obj := range objects {
+		gvr, err := resourceOf(obj)
+		if err != nil {
+			return nil, err
+		}
+		if err := client.tracker.Create(gvr, partialObjectMetadata(obj), obj.GetNamespace()); err != nil {
+			return nil, err
+		}
+	}
+
+	client.PrependReactor("*", "*", kubetesting.ObjectReaction(client.tracker))
+	client.PrependWatchReactor("*", func(action kubetesting.Action) (bool, watch.Interface, error) {
+		w, err := client.tracker.Watch(action.GetResource(), action.GetNamespace())
+		if err != nil {
+			return false, nil, err
+		}
+		return true, w, nil
+	})
+
+	return client, nil
+}
+
+func partialObjectMetadata(obj *unstructured.Unstructured) *meta_v1.PartialObjectMetadata {
+	return &meta_v1.PartialObjectMetadata{
+		TypeMeta: meta_v1.TypeMeta{APIVersion: obj.GetAPIVersion(), Kind: obj.GetKind()},
+		ObjectMeta: meta_v1.ObjectMeta{
+			Namespace:       obj.GetNamespace(),
+			Name:            obj.GetName(),
+			UID:             obj.GetUID(),
+			Labels:          obj.GetLabels(),
+			Annotations:     obj.GetAnnotations(),
+			OwnerReferences: obj.GetOwnerReferences(),
+		},
+	}
+}
+
+func resourceOf(obj *unstructured.Unstructured) (schema.GroupVersionResource, error) {
+	for _, kind := range Kinds {
+		if kind.GroupVersionKind == obj.GroupVersionKind() {
+			return kind.GroupVersionKind.GroupVersion().WithResource(kind.Resource), nil
+		}
+	}
+	return schema.GroupVersionResource{}, fmt.Errorf("unknown kind %s", obj.GroupVersionKind())
+}
+
+// DeleteObject deletes the object from the fake cluster, informers get the delete event.
+func DeleteObject(k *kube.Kube, obj *unstructured.Unstructured) error {
+	dynamicClient, ok := k.Dynamic.(*dynamicfake.FakeDynamicClient)
+	if !ok {
+		return fmt.Errorf("kube is not of the fake cluster")
+	}
+	metadataClient, ok := k.Metadata.(*metadataClient)
+	if !ok {
+		return fmt.Errorf("kube is not of the fake cluster")
+	}
+
+	gvr, err := resourceOf(obj)
+	if err != nil {
+		return err
+	}
+	if err := dynamicClient.Tracker().Delete(gvr, obj.GetNamespace(), obj.GetName()); err != nil {
+		return err
+	}
+	return metadataClient.tracker.Delete(gvr, obj.GetNamespace(), obj.GetName())
+}
+
+// NewObject makes the object fixture, the kind must be one of Kinds.
+func NewObject(kind, namespace, name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	for _, known := range Kinds {
+		if known.GroupVersionKind.Kind == kind {
+			obj.SetGroupVersionKind(known.GroupVersionKind)
+		}
+	}
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	obj.SetUID(types.UID(fmt.Sprintf("%s/%s/%s", namespace, kind, name)))
+	return obj
+}
+
+// WithMetadata sets labels and annotations of the object fixture.
+func WithMetadata(obj *unstructured.Unstructured, labels, annotations map[string]string) *unstructured.Unstructured {
+	if labels != nil {
+		obj.SetLabels(labels)
+	}
+	if annotations != nil {
+		obj.SetAnnotations(annotations)
+	}
+	return obj
+}
+
+// OwnedBy adds the controller owner reference to the object fixture.
+func OwnedBy(obj, owner *unstructured.Unstructured) *unstructured.Unstructured {
+	isController := true
+	obj.SetOwnerReferences(append(obj.GetOwnerReferences(), meta_v1.OwnerReference{
+		APIVersion: owner.GetAPIVersion(),
+		Kind:       owner.GetKind(),
+		Name:       owner.GetName(),
+		UID:        owner.GetUID(),
+		Controller: &isController,
+	}))
+	return obj
+}
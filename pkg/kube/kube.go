@@ -3,24 +3,99 @@ package kube
 import (
 	"fmt"
 	"github.com/romana/rlog"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	TokenFilePath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+	// Informers resync period, 0 means resync disabled: we only read objects from the caches.
+	DefaultResyncPeriod = 0 * time.Second
+
+	// How long the first request of a kind waits for its informer cache to be filled.
+	InformerSyncTimeout = 10 * time.Second
+
+	// Resources are discovered again on requests of unknown kinds at most once per this interval.
+	MapperResetInterval = time.Minute
 )
 
+// Informers of these kinds are started with Kube, informers of other kinds are started on the first request.
+var DefaultInformerKinds = []string{
+	"Namespace",
+	"Pod",
+	"ReplicaSet",
+	"Deployment",
+	"StatefulSet",
+	"DaemonSet",
+	"Job",
+	"CronJob",
+	"PersistentVolumeClaim",
+	"PersistentVolume",
+	"Node",
+}
+
 func IsRunningOutOfKubeCluster() bool {
 	_, err := os.Stat(TokenFilePath)
 	return os.IsNotExist(err)
 }
 
 type Kube struct {
-	Client kubernetes.Interface
+	Client           kubernetes.Interface
+	Dynamic          dynamic.Interface
+	Metadata         metadata.Interface
+	Mapper           meta.RESTMapper
+	Informers        informers.SharedInformerFactory
+	DynamicInformers dynamicinformer.DynamicSharedInformerFactory
+	// MetadataInformers keep only the metadata of objects of all resources except fullObjectResources.
+	MetadataInformers metadatainformer.SharedInformerFactory
+
+	// Tombstones of deleted objects, nil when disabled
+	Tombstones *Tombstones
+	// SyncTimeout is how long the first request of a kind waits for its informer cache to be filled.
+	SyncTimeout time.Duration
+
+	mutex   sync.Mutex
+	stopCh  <-chan struct{}
+	started bool
+	// syncedFuncs are of informers started with Start, informers started later do not affect HasSynced
+	syncedFuncs       []cache.InformerSynced
+	resourceInformers map[schema.GroupVersionResource]informers.GenericInformer
+	informersErrors   map[schema.GroupVersionResource]error
+	unsyncedInformers map[schema.GroupVersionResource]bool
+	lastMapperReset   time.Time
+}
+
+// InformerNotSyncedError is returned when the informer cache is not filled in time,
+// Err is the last error of listing or watching the resource, e.g. forbidden, if any.
+type InformerNotSyncedError struct {
+	Resource string
+	Err      error
+}
+
+func (err *InformerNotSyncedError) Error() string {
+	if err.Err != nil {
+		return fmt.Sprintf("%s informer cache is not synced: %s", err.Resource, err.Err)
+	}
+	return fmt.Sprintf("%s informer cache is not synced", err.Resource)
 }
 
 // TODO: check reconnection to kubernetes
@@ -55,7 +130,281 @@ func NewKube() (*Kube, error) {
 		return nil, fmt.Errorf("kubernetes connection problem: %s", err)
 	}
 
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes dynamic client problem: %s", err)
+	}
+
+	metadataClient, err := metadata.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes metadata client problem: %s", err)
+	}
+
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(client.Discovery()))
+
 	rlog.Info("Kube: successfully configured kubernetes")
 
-	return &Kube{Client: client}, nil
+	return NewKubeWithClients(client, dynamicClient, metadataClient, mapper), nil
+}
+
+func NewKubeWithClients(client kubernetes.Interface, dynamicClient dynamic.Interface, metadataClient metadata.Interface, mapper meta.RESTMapper) *Kube {
+	return &Kube{
+		Client:            client,
+		Dynamic:           dynamicClient,
+		Metadata:          metadataClient,
+		Mapper:            mapper,
+		Informers:         informers.NewSharedInformerFactory(client, DefaultResyncPeriod),
+		DynamicInformers:  dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, DefaultResyncPeriod),
+		MetadataInformers: metadatainformer.NewSharedInformerFactory(metadataClient, DefaultResyncPeriod),
+		SyncTimeout:       InformerSyncTimeout,
+		resourceInformers: make(map[schema.GroupVersionResource]informers.GenericInformer),
+		informersErrors:   make(map[schema.GroupVersionResource]error),
+		unsyncedInformers: make(map[schema.GroupVersionResource]bool),
+	}
+}
+
+// AddInformer registers an optional informer requested from the Informers factory,
+// it should be called before Start.
+func (kube *Kube) AddInformer(informer cache.SharedIndexInformer) {
+	kube.mutex.Lock()
+	defer kube.mutex.Unlock()
+
+	kube.syncedFuncs = append(kube.syncedFuncs, informer.HasSynced)
+}
+
+// EnableTombstones makes GetObject return metadata of objects deleted within the retention period,
+// it should be called before Start.
+func (kube *Kube) EnableTombstones(retention time.Duration) {
+	kube.mutex.Lock()
+	defer kube.mutex.Unlock()
+
+	kube.Tombstones = NewTombstones(retention)
+}
+
+// Start runs registered informers and informers of DefaultInformerKinds in the background until stopCh is closed.
+func (kube *Kube) Start(stopCh <-chan struct{}) {
+	rlog.Info("Kube: starting informers")
+
+	kube.mutex.Lock()
+	kube.stopCh = stopCh
+	kube.mutex.Unlock()
+
+	kube.Informers.Start(stopCh)
+
+	for _, kind := range DefaultInformerKinds {
+		mapping, err := kube.RESTMapping("", kind)
+		if err != nil {
+			rlog.Warnf("Kube: cannot start %s informer: %s", kind, err)
+			continue
+		}
+		kube.resourceInformer(mapping.Resource)
+	}
+
+	kube.mutex.Lock()
+	kube.started = true
+	kube.mutex.Unlock()
+}
+
+// WaitForCacheSync blocks until caches of informers started with Start are synced or stopCh is closed.
+func (kube *Kube) WaitForCacheSync(stopCh <-chan struct{}) bool {
+	return cache.WaitForCacheSync(stopCh, kube.syncedFuncsCopy()...)
+}
+
+// HasSynced reports whether caches of informers started with Start have been filled with the initial list.
+// Informers started later on requests of other kinds are not counted: listing such kinds may be forbidden.
+func (kube *Kube) HasSynced() bool {
+	for _, synced := range kube.syncedFuncsCopy() {
+		if !synced() {
+			return false
+		}
+	}
+	return true
+}
+
+func (kube *Kube) syncedFuncsCopy() []cache.InformerSynced {
+	kube.mutex.Lock()
+	defer kube.mutex.Unlock()
+
+	res := make([]cache.InformerSynced, len(kube.syncedFuncs))
+	copy(res, kube.syncedFuncs)
+	return res
+}
+
+// RESTMapping finds the resource of the kind. Kind may be qualified with the group as "Kind.group",
+// when apiVersion and group are not specified the kind is searched in all groups.
+func (kube *Kube) RESTMapping(apiVersion, kind string) (*meta.RESTMapping, error) {
+	mapping, err := kube.restMapping(apiVersion, kind)
+	if meta.IsNoMatchError(err) {
+		// The kind may be a new CRD, discover resources again
+		if resettable, ok := kube.Mapper.(interface{ Reset() }); ok && kube.allowMapperReset() {
+			rlog.Infof("Kube: kind %s is not found, discovering resources again", kind)
+			resettable.Reset()
+			mapping, err = kube.restMapping(apiVersion, kind)
+		}
+	}
+	return mapping, err
+}
+
+// allowMapperReset limits discovery to once per MapperResetInterval,
+// so alerts with unknown or mistyped kinds do not load the API server.
+func (kube *Kube) allowMapperReset() bool {
+	kube.mutex.Lock()
+	defer kube.mutex.Unlock()
+
+	if !kube.lastMapperReset.IsZero() && time.Since(kube.lastMapperReset) < MapperResetInterval {
+		return false
+	}
+	kube.lastMapperReset = time.Now()
+	return true
+}
+
+func (kube *Kube) restMapping(apiVersion, kind string) (*meta.RESTMapping, error) {
+	if apiVersion != "" {
+		gv, err := schema.ParseGroupVersion(apiVersion)
+		if err != nil {
+			return nil, err
+		}
+		return kube.Mapper.RESTMapping(gv.WithKind(kind).GroupKind(), gv.Version)
+	}
+
+	gk := schema.ParseGroupKind(kind)
+	if gk.Group == "" {
+		// Singular lowercase resource name equals to the lowercase kind
+		gvks, err := kube.Mapper.KindsFor(schema.GroupVersionResource{Resource: strings.ToLower(gk.Kind)})
+		if err == nil && len(gvks) > 0 {
+			gk = gvks[0].GroupKind()
+		}
+	}
+
+	return kube.Mapper.RESTMapping(gk)
+}
+
+// resourceInformer returns the informer of the resource starting it on the first call: the dynamic informer
+// of full objects for fullObjectResources, the metadata informer for other resources.
+func (kube *Kube) resourceInformer(gvr schema.GroupVersionResource) (informers.GenericInformer, error) {
+	kube.mutex.Lock()
+	defer kube.mutex.Unlock()
+
+	if informer, hasKey := kube.resourceInformers[gvr]; hasKey {
+		return informer, nil
+	}
+
+	if kube.stopCh == nil {
+		return nil, fmt.Errorf("informers are not started")
+	}
+
+	var informer informers.GenericInformer
+	if fullObjectResources[gvr] {
+		rlog.Infof("Kube: starting %s informer", gvr.String())
+		informer = kube.DynamicInformers.ForResource(gvr)
+	} else {
+		rlog.Infof("Kube: starting %s metadata informer", gvr.String())
+		informer = kube.MetadataInformers.ForResource(gvr)
+	}
+	if gvr == nodesResource {
+		// Indexers should be added before the informer is started
+		if err := informer.Informer().AddIndexers(cache.Indexers{NodeAddressIndex: nodeAddressIndexFunc}); err != nil {
+			rlog.Warnf("Kube: cannot add %s informer index: %s", gvr.String(), err)
+		}
+	}
+	if kube.Tombstones != nil {
+		informer.Informer().AddEventHandler(kube.Tombstones.EventHandler(gvr))
+	}
+	err := informer.Informer().SetWatchErrorHandler(func(_ *cache.Reflector, err error) {
+		rlog.Errorf("Kube: %s informer list or watch failed: %s", gvr.String(), err)
+
+		kube.mutex.Lock()
+		defer kube.mutex.Unlock()
+		kube.informersErrors[gvr] = err
+	})
+	if err != nil {
+		rlog.Warnf("Kube: cannot set %s informer error handler: %s", gvr.String(), err)
+	}
+	if !kube.started {
+		kube.syncedFuncs = append(kube.syncedFuncs, informer.Informer().HasSynced)
+	}
+	kube.resourceInformers[gvr] = informer
+	if fullObjectResources[gvr] {
+		kube.DynamicInformers.Start(kube.stopCh)
+	} else {
+		kube.MetadataInformers.Start(kube.stopCh)
+	}
+
+	return informer, nil
+}
+
+// waitForInformerSync waits for the informer cache to be filled once. Later requests of the kind fail fast
+// until the informer syncs, as do requests of a kind which is forbidden to list.
+func (kube *Kube) waitForInformerSync(gvr schema.GroupVersionResource, informer informers.GenericInformer) error {
+	kube.mutex.Lock()
+	failFast := kube.unsyncedInformers[gvr] || errors.IsForbidden(kube.informersErrors[gvr])
+	kube.mutex.Unlock()
+
+	if !failFast {
+		timeoutCh := make(chan struct{})
+		timer := time.AfterFunc(kube.SyncTimeout, func() { close(timeoutCh) })
+		synced := cache.WaitForCacheSync(timeoutCh, informer.Informer().HasSynced)
+		timer.Stop()
+		if synced {
+			return nil
+		}
+	}
+
+	kube.mutex.Lock()
+	defer kube.mutex.Unlock()
+
+	kube.unsyncedInformers[gvr] = true
+	return &InformerNotSyncedError{Resource: gvr.String(), Err: kube.informersErrors[gvr]}
+}
+
+// GetObject returns the object from informer cache, the informer of the kind is started on the first request.
+// Only the metadata is returned for kinds other than fullObjectResources.
+// Namespace is ignored for cluster-scoped kinds. Metadata of a recently deleted object is returned from Tombstones.
+func (kube *Kube) GetObject(apiVersion, kind, namespace, name string) (*unstructured.Unstructured, error) {
+	mapping, err := kube.RESTMapping(apiVersion, kind)
+	if err != nil {
+		return nil, err
+	}
+
+	informer, err := kube.resourceInformer(mapping.Resource)
+	if err != nil {
+		return nil, err
+	}
+
+	if !informer.Informer().HasSynced() {
+		if err := kube.waitForInformerSync(mapping.Resource, informer); err != nil {
+			return nil, err
+		}
+	}
+
+	var obj interface{}
+	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
+		namespace = ""
+		obj, err = informer.Lister().Get(name)
+	} else {
+		obj, err = informer.Lister().ByNamespace(namespace).Get(name)
+	}
+	if errors.IsNotFound(err) {
+		if tombstone, hasKey := kube.Tombstones.Get(mapping.Resource, namespace, name); hasKey {
+			rlog.Debugf("Kube: %s %s/%s is deleted, using its tombstone", mapping.Resource.String(), namespace, name)
+			obj, err = tombstone, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if res, ok := obj.(*unstructured.Unstructured); ok && fullObjectResources[mapping.Resource] {
+		return res, nil
+	}
+
+	// Metadata informers objects and tombstones get the kind of the mapping,
+	// the API server returns metadata as PartialObjectMetadata kind
+	res, err := metadataObject(obj)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", mapping.Resource.String(), err)
+	}
+	res.SetGroupVersionKind(mapping.GroupVersionKind)
+
+	return res, nil
 }
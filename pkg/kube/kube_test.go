@@ -0,0 +1,142 @@
+package kube_test
+
+import (
+	"fmt"
+	"github.com/flant/promicher/pkg/kube"
+	"github.com/flant/promicher/pkg/kube/fake"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubernetesfake "k8s.io/client-go/kubernetes/fake"
+	metadatafake "k8s.io/client-go/metadata/fake"
+	"testing"
+	"time"
+)
+
+func TestGetObjectForbiddenKind(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	forbidden := errors.NewForbidden(schema.GroupResource{Group: "argoproj.io", Resource: "rollouts"}, "", fmt.Errorf("denied"))
+	k, err := fake.NewKubeWithOptions(stopCh, fake.Options{Failures: []fake.Failure{{Verb: "list", Resource: "rollouts", Err: forbidden}}}, fake.NewCluster()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.SyncTimeout = 200 * time.Millisecond
+
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		_, err := k.GetObject("", "Rollout", fake.ClusterNamespace, "web")
+		notSyncedErr, ok := err.(*kube.InformerNotSyncedError)
+		if !ok {
+			t.Fatalf("expected InformerNotSyncedError, got %v", err)
+		}
+		if i == 1 {
+			if !errors.IsForbidden(notSyncedErr.Err) {
+				t.Errorf("expected forbidden cause, got %v", notSyncedErr.Err)
+			}
+			if elapsed := time.Since(start); elapsed >= k.SyncTimeout {
+				t.Errorf("expected the second request to fail fast, it took %s", elapsed)
+			}
+		}
+	}
+
+	if !k.HasSynced() {
+		t.Errorf("expected informers started on start to be synced regardless of the forbidden kind")
+	}
+
+	if _, err := k.GetObject("", "Pod", fake.ClusterNamespace, fake.ClusterPod); err != nil {
+		t.Errorf("expected other kinds to be loaded, got %s", err)
+	}
+}
+
+type resettableMapper struct {
+	meta.RESTMapper
+	resets int
+}
+
+func (mapper *resettableMapper) Reset() {
+	mapper.resets++
+}
+
+func TestRESTMappingResetIsRateLimited(t *testing.T) {
+	mapper := &resettableMapper{RESTMapper: fake.NewMapper()}
+	k := kube.NewKubeWithClients(kubernetesfake.NewSimpleClientset(), dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()),
+		metadatafake.NewSimpleMetadataClient(runtime.NewScheme()), mapper)
+
+	for i := 0; i < 3; i++ {
+		if _, err := k.RESTMapping("", "Unknown"); !meta.IsNoMatchError(err) {
+			t.Fatalf("expected no match error, got %v", err)
+		}
+	}
+
+	if mapper.resets != 1 {
+		t.Errorf("expected 1 discovery reset, got %d", mapper.resets)
+	}
+}
+
+func TestFindNodeByAddress(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	k, err := fake.NewKube(stopCh, fake.NewCluster()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		address  string
+		expected string
+	}{
+		{fake.ClusterNodeIP + ":9100", fake.ClusterNode},
+		{fake.ClusterNodeIP, fake.ClusterNode},
+		{fake.ClusterNode + ":9100", fake.ClusterNode},
+		{"10.0.1.6:9100", ""},
+		{":9100", ""},
+	}
+
+	for _, test := range tests {
+		name, err := k.FindNodeByAddress(test.address)
+		if err != nil {
+			t.Errorf("%s: %s", test.address, err)
+		}
+		if name != test.expected {
+			t.Errorf("%s: expected node '%s', got '%s'", test.address, test.expected, name)
+		}
+	}
+}
+
+func TestGetObjectMetadataOnly(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	pod := fake.WithMetadata(fake.NewObject("Pod", "shop", "web-x"), map[string]string{"app": "web"}, nil)
+	pod.Object["spec"] = map[string]interface{}{"nodeName": fake.ClusterNode}
+
+	k, err := fake.NewKube(stopCh, append(fake.NewCluster(), pod)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := k.GetObject("", "Pod", "shop", "web-x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.GetKind() != "Pod" || obj.GetAPIVersion() != "v1" || obj.GetLabels()["app"] != "web" {
+		t.Errorf("expected pod metadata, got %v", obj.Object)
+	}
+	if _, hasSpec := obj.Object["spec"]; hasSpec {
+		t.Errorf("expected only the pod metadata to be kept, got %v", obj.Object)
+	}
+
+	// Node addresses are read from the node status
+	node, err := k.GetObject("", "Node", "", fake.ClusterNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, hasStatus := node.Object["status"]; !hasStatus {
+		t.Errorf("expected the full node object, got %v", node.Object)
+	}
+}
@@ -0,0 +1,38 @@
+package kube
+
+import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// fullObjectResources are resources which informers keep full objects because their fields are read,
+// e.g. node addresses. Informers of other resources keep only the metadata: rules select labels and annotations,
+// and owners are followed by owner references, so pods specs and statuses are not kept in memory.
+var fullObjectResources = map[schema.GroupVersionResource]bool{
+	nodesResource: true,
+}
+
+// metadataObject copies the metadata rules select of the informer object, which is *unstructured.Unstructured
+// or *meta_v1.PartialObjectMetadata, to the unstructured object of the same kind.
+func metadataObject(obj interface{}) (*unstructured.Unstructured, error) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected object type %T: %s", obj, err)
+	}
+
+	res := &unstructured.Unstructured{}
+	if runtimeObj, ok := obj.(runtime.Object); ok {
+		res.SetGroupVersionKind(runtimeObj.GetObjectKind().GroupVersionKind())
+	}
+	res.SetNamespace(accessor.GetNamespace())
+	res.SetName(accessor.GetName())
+	res.SetUID(accessor.GetUID())
+	res.SetLabels(accessor.GetLabels())
+	res.SetAnnotations(accessor.GetAnnotations())
+	res.SetOwnerReferences(accessor.GetOwnerReferences())
+
+	return res, nil
+}
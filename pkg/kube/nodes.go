@@ -0,0 +1,84 @@
+package kube
+
+import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"net"
+	"strings"
+)
+
+// NodeAddressIndex is the name of the Node informer index by node name and status.addresses.
+const NodeAddressIndex = "address"
+
+var nodesResource = schema.GroupVersionResource{Version: "v1", Resource: "nodes"}
+
+// nodeAddressIndexFunc indexes nodes by name and every address or hostname in status.addresses.
+func nodeAddressIndexFunc(obj interface{}) ([]string, error) {
+	node, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected node object type %T", obj)
+	}
+
+	res := []string{node.GetName()}
+
+	addresses, _, err := unstructured.NestedSlice(node.Object, "status", "addresses")
+	if err != nil {
+		return res, nil
+	}
+	for _, item := range addresses {
+		nodeAddress, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if address, ok := nodeAddress["address"].(string); ok && address != "" && address != node.GetName() {
+			res = append(res, address)
+		}
+	}
+
+	return res, nil
+}
+
+// FindNodeByAddress returns the name of the node with the address or hostname in status.addresses,
+// the address may contain a port, e.g. "10.0.1.5:9100". Empty name is returned when no node matches.
+func (kube *Kube) FindNodeByAddress(address string) (string, error) {
+	host := address
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if host == "" {
+		return "", nil
+	}
+
+	mapping, err := kube.RESTMapping("v1", "Node")
+	if err != nil {
+		return "", err
+	}
+
+	informer, err := kube.resourceInformer(mapping.Resource)
+	if err != nil {
+		return "", err
+	}
+
+	if !informer.Informer().HasSynced() {
+		if err := kube.waitForInformerSync(mapping.Resource, informer); err != nil {
+			return "", err
+		}
+	}
+
+	objs, err := informer.Informer().GetIndexer().ByIndex(NodeAddressIndex, host)
+	if err != nil {
+		return "", err
+	}
+	if len(objs) == 0 {
+		return "", nil
+	}
+
+	node, ok := objs[0].(*unstructured.Unstructured)
+	if !ok {
+		return "", fmt.Errorf("unexpected node object type %T", objs[0])
+	}
+
+	return node.GetName(), nil
+}
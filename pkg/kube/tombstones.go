@@ -0,0 +1,118 @@
+package kube
+
+import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"sync"
+	"time"
+)
+
+// Tombstones keep metadata of deleted objects for the retention period,
+// so alerts about already deleted pods and finished jobs are still enriched.
+type Tombstones struct {
+	Retention time.Duration
+
+	mutex   sync.Mutex
+	objects map[string]*tombstone
+	// expiring are tombstones in the order of expiration: the retention is the same for all of them
+	expiring []*tombstone
+	now      func() time.Time
+}
+
+type tombstone struct {
+	key       string
+	obj       *unstructured.Unstructured
+	expiresAt time.Time
+}
+
+func NewTombstones(retention time.Duration) *Tombstones {
+	return &Tombstones{
+		Retention: retention,
+		objects:   make(map[string]*tombstone),
+		now:       time.Now,
+	}
+}
+
+func tombstoneKey(gvr schema.GroupVersionResource, namespace, name string) string {
+	return fmt.Sprintf("%s %s/%s", gvr.String(), namespace, name)
+}
+
+// EventHandler records objects of the resource deleted from the informer.
+func (tombstones *Tombstones) EventHandler(gvr schema.GroupVersionResource) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		DeleteFunc: func(obj interface{}) {
+			tombstones.Add(gvr, obj)
+		},
+	}
+}
+
+// Add records metadata of the deleted object, obj may be the informer DeletedFinalStateUnknown.
+func (tombstones *Tombstones) Add(gvr schema.GroupVersionResource, obj interface{}) {
+	if deleted, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = deleted.Obj
+	}
+
+	// Only metadata is kept: it is what rules select, and it keeps tombstones small
+	res, err := metadataObject(obj)
+	if err != nil {
+		return
+	}
+
+	tombstones.mutex.Lock()
+	defer tombstones.mutex.Unlock()
+
+	now := tombstones.now()
+	tombstones.sweep(now)
+
+	added := &tombstone{
+		key:       tombstoneKey(gvr, res.GetNamespace(), res.GetName()),
+		obj:       res,
+		expiresAt: now.Add(tombstones.Retention),
+	}
+	tombstones.objects[added.key] = added
+	tombstones.expiring = append(tombstones.expiring, added)
+}
+
+// sweep drops expired tombstones from the head of the expiration order, so they do not pile up.
+func (tombstones *Tombstones) sweep(now time.Time) {
+	for len(tombstones.expiring) > 0 && !now.Before(tombstones.expiring[0].expiresAt) {
+		expired := tombstones.expiring[0]
+		// The object may be deleted again after it was recreated, then the key has a newer tombstone
+		if tombstones.objects[expired.key] == expired {
+			delete(tombstones.objects, expired.key)
+		}
+		tombstones.expiring[0] = nil
+		tombstones.expiring = tombstones.expiring[1:]
+	}
+}
+
+// Get returns metadata of the object deleted within the retention period, tombstones may be nil.
+func (tombstones *Tombstones) Get(gvr schema.GroupVersionResource, namespace, name string) (*unstructured.Unstructured, bool) {
+	if tombstones == nil {
+		return nil, false
+	}
+
+	tombstones.mutex.Lock()
+	defer tombstones.mutex.Unlock()
+
+	tombstone, hasKey := tombstones.objects[tombstoneKey(gvr, namespace, name)]
+	if !hasKey || !tombstones.now().Before(tombstone.expiresAt) {
+		return nil, false
+	}
+
+	return tombstone.obj, true
+}
+
+// Len returns the number of kept tombstones including expired ones not dropped yet, tombstones may be nil.
+func (tombstones *Tombstones) Len() int {
+	if tombstones == nil {
+		return 0
+	}
+
+	tombstones.mutex.Lock()
+	defer tombstones.mutex.Unlock()
+
+	return len(tombstones.objects)
+}
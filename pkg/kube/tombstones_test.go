@@ -0,0 +1,90 @@
+package kube
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"testing"
+	"time"
+)
+
+func TestTombstones(t *testing.T) {
+	pods := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+	now := time.Now()
+	tombstones := NewTombstones(time.Hour)
+	tombstones.now = func() time.Time { return now }
+
+	pod := &unstructured.Unstructured{}
+	pod.SetAPIVersion("v1")
+	pod.SetKind("Pod")
+	pod.SetNamespace("shop")
+	pod.SetName("web-x")
+	pod.SetLabels(map[string]string{"app": "web"})
+	pod.Object["spec"] = map[string]interface{}{"nodeName": "node-1"}
+
+	handler := tombstones.EventHandler(pods)
+	handler.OnDelete(cache.DeletedFinalStateUnknown{Key: "shop/web-x", Obj: pod})
+
+	obj, hasKey := tombstones.Get(pods, "shop", "web-x")
+	if !hasKey {
+		t.Fatal("expected the tombstone of the deleted pod")
+	}
+	if obj.GetLabels()["app"] != "web" || obj.GetKind() != "Pod" {
+		t.Errorf("expected pod metadata, got %v", obj.Object)
+	}
+	if _, hasSpec := obj.Object["spec"]; hasSpec {
+		t.Errorf("expected metadata only, got %v", obj.Object)
+	}
+
+	if _, hasKey := tombstones.Get(pods, "other", "web-x"); hasKey {
+		t.Error("expected no tombstone of the pod in other namespace")
+	}
+
+	now = now.Add(2 * time.Hour)
+	if _, hasKey := tombstones.Get(pods, "shop", "web-x"); hasKey {
+		t.Error("expected the tombstone to expire")
+	}
+
+	other := pod.DeepCopy()
+	other.SetName("web-y")
+	tombstones.Add(pods, other)
+	if tombstones.Len() != 1 {
+		t.Errorf("expected expired tombstones to be dropped, got %d", tombstones.Len())
+	}
+
+	var disabled *Tombstones
+	if _, hasKey := disabled.Get(pods, "shop", "web-y"); hasKey || disabled.Len() != 0 {
+		t.Error("expected nil tombstones to be empty")
+	}
+}
+
+func TestTombstonesSweep(t *testing.T) {
+	pods := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+	now := time.Now()
+	tombstones := NewTombstones(time.Hour)
+	tombstones.now = func() time.Time { return now }
+
+	pod := &unstructured.Unstructured{}
+	pod.SetNamespace("shop")
+	pod.SetName("web-x")
+
+	tombstones.Add(pods, pod)
+
+	// The pod is recreated and deleted again later
+	now = now.Add(30 * time.Minute)
+	tombstones.Add(pods, pod)
+
+	now = now.Add(45 * time.Minute)
+	other := pod.DeepCopy()
+	other.SetName("web-y")
+	tombstones.Add(pods, other)
+
+	if _, hasKey := tombstones.Get(pods, "shop", "web-x"); !hasKey {
+		t.Error("expected the newer tombstone to be kept when the older one expires")
+	}
+	if tombstones.Len() != 2 {
+		t.Errorf("expected 2 tombstones, got %d", tombstones.Len())
+	}
+}
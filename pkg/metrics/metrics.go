@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+const Namespace = "promicher"
+
+var (
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "requests_total",
+		Help:      "Alerts requests received from Prometheus by Alertmanager API version and response code.",
+	}, []string{"api_version", "code"})
+
+	AlertsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "alerts_received_total",
+		Help:      "Alerts received from Prometheus by Alertmanager API version.",
+	}, []string{"api_version"})
+
+	AlertsProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "alerts_processed_total",
+		Help:      "Processed alerts by the target kubernetes kind and outcome: enriched, partial, cached, cache_fallback, unresolved, no_target or error.",
+	}, []string{"kind", "outcome"})
+
+	AlertsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "alerts_failed_total",
+		Help:      "Alerts which failed to enrich by the action taken according to the failed alert policy: forwarded unchanged or dropped, and the reason: a load error reason, merge_error or unknown.",
+	}, []string{"action", "reason"})
+
+	KubeLoadErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "kube_load_errors_total",
+		Help:      "Errors of loading kubernetes objects related to alerts by the object kind and reason: not_found, forbidden, timeout, unsupported_kind or unknown.",
+	}, []string{"kind", "reason"})
+
+	KubeLoadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "kube_load_duration_seconds",
+		Help:      "Duration of loading kubernetes data of the alert target by the target kind.",
+		Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"kind"})
+
+	ForwardRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "forward_requests_total",
+		Help:      "Requests to Alertmanager destinations by destination, the URL or the service of service destinations, and outcome: success or failure.",
+	}, []string{"destination", "outcome"})
+
+	ForwardDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "forward_duration_seconds",
+		Help:      "Duration of requests to Alertmanager destinations by destination, the URL or the service of service destinations.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"destination"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		Requests,
+		AlertsReceived,
+		AlertsProcessed,
+		AlertsFailed,
+		KubeLoadDuration,
+		KubeLoadErrors,
+		ForwardRequests,
+		ForwardDuration,
+	)
+}
+
+// RegisterCounterFunc exports a counter maintained outside of the metrics package, e.g. by a cache.
+func RegisterCounterFunc(name, help string, f func() float64) {
+	prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      name,
+		Help:      help,
+	}, f))
+}
+
+// RegisterGaugeFunc exports a gauge maintained outside of the metrics package, e.g. a queue length.
+func RegisterGaugeFunc(name, help string, f func() float64) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      name,
+		Help:      help,
+	}, f))
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -3,6 +3,9 @@ package promicher
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/flant/promicher/pkg/kube"
+	"hash/fnv"
+	"sort"
 	"strings"
 	"time"
 )
@@ -16,7 +19,9 @@ type Alert struct {
 	StartsAt time.Time `json:"-"`
 	EndsAt   time.Time `json:"-"`
 
-	raw map[string]interface{} `json:",inline"`
+	raw map[string]interface{}
+	// sourceFingerprint is the fingerprint of the alert labels before the enrichment
+	sourceFingerprint string
 }
 
 func (alert *Alert) UnmarshalJSON(b []byte) error {
@@ -36,25 +41,95 @@ func (alert *Alert) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-func (alert *Alert) MarshalJSON() ([]byte, error) {
-	alert.raw["labels"] = alert.Labels
-	alert.raw["annotations"] = alert.Annotations
-	alert.raw["startsAt"] = alert.StartsAtRaw
-	alert.raw["endsAt"] = alert.EndsAtRaw
+// Fields of the Alertmanager API v2 postableAlert object
+var apiV2AlertFields = map[string]bool{
+	"labels":       true,
+	"annotations":  true,
+	"startsAt":     true,
+	"endsAt":       true,
+	"generatorURL": true,
+}
+
+func (alert *Alert) rawData() map[string]interface{} {
+	// Alert may be shared through the alerts cache, so raw data should not be modified in place
+	raw := make(map[string]interface{})
+	for k, v := range alert.raw {
+		raw[k] = v
+	}
+
+	raw["labels"] = alert.Labels
+	raw["annotations"] = alert.Annotations
 
-	return json.Marshal(alert.raw)
+	delete(raw, "startsAt")
+	if alert.StartsAtRaw != "" {
+		raw["startsAt"] = alert.StartsAtRaw
+	}
+
+	delete(raw, "endsAt")
+	if alert.EndsAtRaw != "" {
+		raw["endsAt"] = alert.EndsAtRaw
+	}
+
+	return raw
+}
+
+func (alert *Alert) MarshalJSON() ([]byte, error) {
+	return json.Marshal(alert.rawData())
 }
 
 type KubeResourceInfo struct {
 	Namespace string
-	Kind      string
-	Name      string
+	// APIVersion is optional, the kind is searched in all API groups when it is empty.
+	APIVersion string
+	Kind       string
+	Name       string
 }
 
 func (resource *KubeResourceInfo) CacheId() string {
+	if resource.Namespace == "" {
+		return fmt.Sprintf("%s/%s", strings.ToLower(resource.Kind), resource.Name)
+	}
 	return fmt.Sprintf("ns/%s %s/%s", resource.Namespace, strings.ToLower(resource.Kind), resource.Name)
 }
 
+// SourceFingerprint returns the fingerprint of the alert labels before the enrichment,
+// it matches the enriched alert with the original one.
+func (alert *Alert) SourceFingerprint() string {
+	if alert.sourceFingerprint != "" {
+		return alert.sourceFingerprint
+	}
+	return alert.Fingerprint()
+}
+
+// Fingerprint identifies the alert by its labels as Alertmanager does,
+// so firing and resolved notifications of the alert have the same fingerprint.
+func (alert *Alert) Fingerprint() string {
+	names := make([]string, 0, len(alert.Labels))
+	for name := range alert.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// The separator is not a valid UTF-8 byte, so it never occurs in label names and values
+	separator := []byte{255}
+
+	hash := fnv.New64a()
+	for _, name := range names {
+		hash.Write([]byte(name))
+		hash.Write(separator)
+		hash.Write([]byte(alert.Labels[name]))
+		hash.Write(separator)
+	}
+
+	return fmt.Sprintf("%016x", hash.Sum64())
+}
+
+// IsResolved reports whether the alert has ended by now. Prometheus sets endsAt of firing alerts
+// in the future, so alerts with endsAt are not necessarily resolved.
+func (alert *Alert) IsResolved(now time.Time) bool {
+	return !alert.EndsAt.IsZero() && !alert.EndsAt.After(now)
+}
+
 func (alert *Alert) String() string {
 	alertBytes, err := json.MarshalIndent(alert, "", "  ")
 	if err != nil {
@@ -64,38 +139,18 @@ func (alert *Alert) String() string {
 	return string(alertBytes)
 }
 
-func (alert *Alert) KubeTargetResourceInfo() *KubeResourceInfo {
-	if ns, hasKey := alert.Labels["namespace"]; hasKey {
-		for _, kind := range []string{
-			"Pod",
-			"Deployment",
-			"StatefulSet",
-			"DaemonSet",
-			"Job",
-			"CronJob",
-			"PersistentVolumeClaim",
-			"PersistentVolume",
-		} {
-			if name, hasKey := alert.Labels[strings.ToLower(kind)]; hasKey {
-				return &KubeResourceInfo{
-					Namespace: ns,
-					Kind:      kind,
-					Name:      name,
-				}
-			}
-		}
-
-		return &KubeResourceInfo{
-			Namespace: "",
-			Kind:      "Namespace",
-			Name:      ns,
+// KubeTargetResourceInfo returns the object of the first matching target or nil if no target matches.
+func (alert *Alert) KubeTargetResourceInfo(kube *kube.Kube, targets []*Target) *KubeResourceInfo {
+	for _, target := range targets {
+		if resource := target.Resolve(kube, alert); resource != nil {
+			return resource
 		}
 	}
 
 	return nil
 }
 
-func ParseAlerts(data []byte) ([]Alert, error) {
+func ParseAlerts(data []byte, version APIVersion) ([]Alert, error) {
 	var res []Alert
 	var err error
 
@@ -107,22 +162,47 @@ func ParseAlerts(data []byte) ([]Alert, error) {
 	for i := range res {
 		alert := &res[i]
 
-		alert.StartsAt, err = time.Parse(time.RFC3339, alert.StartsAtRaw)
-		if err != nil {
-			return nil, fmt.Errorf("Bad alert `startsAt` field data \"%s\": %s", alert.StartsAtRaw, err)
+		// startsAt and endsAt are optional in the API v2
+		if alert.StartsAtRaw != "" || version == APIv1 {
+			alert.StartsAt, err = time.Parse(time.RFC3339, alert.StartsAtRaw)
+			if err != nil {
+				return nil, fmt.Errorf("Bad alert `startsAt` field data \"%s\": %s", alert.StartsAtRaw, err)
+			}
+		}
+
+		if alert.EndsAtRaw != "" || version == APIv1 {
+			alert.EndsAt, err = time.Parse(time.RFC3339, alert.EndsAtRaw)
+			if err != nil {
+				return nil, fmt.Errorf("Bad alert `endsAt` field data \"%s\": %s", alert.EndsAtRaw, err)
+			}
 		}
 
-		alert.EndsAt, err = time.Parse(time.RFC3339, alert.EndsAtRaw)
-		if err != nil {
-			return nil, fmt.Errorf("Bad alert `endsAt` field data \"%s\": %s", alert.EndsAtRaw, err)
+		if version == APIv2 && len(alert.Labels) == 0 {
+			return nil, fmt.Errorf("Bad alert: `labels` field is required by the API %s", version)
 		}
 	}
 
 	return res, nil
 }
 
-func DumpAlerts(alerts []Alert) ([]byte, error) {
-	data, err := json.Marshal(alerts)
+func DumpAlerts(alerts []Alert, version APIVersion) ([]byte, error) {
+	res := make([]map[string]interface{}, 0, len(alerts))
+
+	for i := range alerts {
+		raw := alerts[i].rawData()
+
+		if version == APIv2 {
+			for k := range raw {
+				if !apiV2AlertFields[k] {
+					delete(raw, k)
+				}
+			}
+		}
+
+		res = append(res, raw)
+	}
+
+	data, err := json.Marshal(res)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,199 @@
+package promicher
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// AlertsCache stores last successfully enriched alerts,
+// it is used when kube resource of the alert is not available anymore.
+type AlertsCache interface {
+	Get(key string) (Alert, bool)
+	Set(key string, alert Alert)
+	Len() int
+	Stats() AlertsCacheStats
+}
+
+type AlertsCacheStats struct {
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64
+	Expirations uint64
+	Entries     int
+}
+
+type alertsCacheEntry struct {
+	key       string
+	alert     Alert
+	expiresAt time.Time
+}
+
+// LRUAlertsCache is a lock-protected AlertsCache with maximum entries count,
+// least recently used entries eviction and entries TTL.
+type LRUAlertsCache struct {
+	MaxEntries int
+	TTL        time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	stats   AlertsCacheStats
+	now     func() time.Time
+}
+
+func NewLRUAlertsCache(maxEntries int, ttl time.Duration) *LRUAlertsCache {
+	return &LRUAlertsCache{
+		MaxEntries: maxEntries,
+		TTL:        ttl,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		now:        time.Now,
+	}
+}
+
+func (cache *LRUAlertsCache) Get(key string) (Alert, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	elem, hasKey := cache.entries[key]
+	if !hasKey {
+		cache.stats.Misses++
+		return Alert{}, false
+	}
+
+	entry := elem.Value.(*alertsCacheEntry)
+	if cache.isExpired(entry) {
+		cache.removeElement(elem)
+		cache.stats.Expirations++
+		cache.stats.Misses++
+		return Alert{}, false
+	}
+
+	cache.lru.MoveToFront(elem)
+	cache.stats.Hits++
+
+	return entry.alert, true
+}
+
+func (cache *LRUAlertsCache) Set(key string, alert Alert) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	expiresAt := time.Time{}
+	if cache.TTL > 0 {
+		expiresAt = cache.now().Add(cache.TTL)
+	}
+
+	if elem, hasKey := cache.entries[key]; hasKey {
+		entry := elem.Value.(*alertsCacheEntry)
+		entry.alert = alert
+		entry.expiresAt = expiresAt
+		cache.lru.MoveToFront(elem)
+	} else {
+		cache.entries[key] = cache.lru.PushFront(&alertsCacheEntry{
+			key:       key,
+			alert:     alert,
+			expiresAt: expiresAt,
+		})
+	}
+
+	// Drop expired entries from the tail first, then evict least recently used entries over the limit.
+	for elem := cache.lru.Back(); elem != nil && cache.isExpired(elem.Value.(*alertsCacheEntry)); elem = cache.lru.Back() {
+		cache.removeElement(elem)
+		cache.stats.Expirations++
+	}
+
+	for cache.MaxEntries > 0 && cache.lru.Len() > cache.MaxEntries {
+		cache.removeElement(cache.lru.Back())
+		cache.stats.Evictions++
+	}
+}
+
+func (cache *LRUAlertsCache) Len() int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	return cache.lru.Len()
+}
+
+func (cache *LRUAlertsCache) Stats() AlertsCacheStats {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	stats := cache.stats
+	stats.Entries = cache.lru.Len()
+
+	return stats
+}
+
+func (cache *LRUAlertsCache) isExpired(entry *alertsCacheEntry) bool {
+	return !entry.expiresAt.IsZero() && !cache.now().Before(entry.expiresAt)
+}
+
+func (cache *LRUAlertsCache) removeElement(elem *list.Element) {
+	cache.lru.Remove(elem)
+	delete(cache.entries, elem.Value.(*alertsCacheEntry).key)
+}
+
+// AlertsCacheSnapshotEntry is the enrichment of the alert stored in the alerts cache snapshot.
+type AlertsCacheSnapshotEntry struct {
+	Fingerprint string            `json:"fingerprint"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	ExpiresAt   time.Time         `json:"expiresAt,omitempty"`
+}
+
+// Snapshot returns not expired entries from the most to the least recently used.
+func (cache *LRUAlertsCache) Snapshot() []*AlertsCacheSnapshotEntry {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	res := make([]*AlertsCacheSnapshotEntry, 0, cache.lru.Len())
+	for elem := cache.lru.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*alertsCacheEntry)
+		if cache.isExpired(entry) {
+			continue
+		}
+		res = append(res, &AlertsCacheSnapshotEntry{
+			Fingerprint: entry.key,
+			Labels:      entry.alert.Labels,
+			Annotations: entry.alert.Annotations,
+			ExpiresAt:   entry.expiresAt,
+		})
+	}
+
+	return res
+}
+
+// Restore adds snapshot entries missing in the cache keeping their order and expiration time,
+// expired entries and entries over MaxEntries are skipped. It returns the number of restored entries.
+func (cache *LRUAlertsCache) Restore(snapshot []*AlertsCacheSnapshotEntry) int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	restored := 0
+	for _, snapshotEntry := range snapshot {
+		if cache.MaxEntries > 0 && cache.lru.Len() >= cache.MaxEntries {
+			break
+		}
+		if _, hasKey := cache.entries[snapshotEntry.Fingerprint]; hasKey {
+			continue
+		}
+
+		entry := &alertsCacheEntry{
+			key:       snapshotEntry.Fingerprint,
+			alert:     Alert{Labels: snapshotEntry.Labels, Annotations: snapshotEntry.Annotations},
+			expiresAt: snapshotEntry.ExpiresAt,
+		}
+		if cache.isExpired(entry) {
+			continue
+		}
+
+		// Snapshot goes from the most recently used entry, so restored entries are older than present ones
+		cache.entries[entry.key] = cache.lru.PushBack(entry)
+		restored++
+	}
+
+	return restored
+}
@@ -0,0 +1,132 @@
+package promicher
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/romana/rlog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// AlertsCacheSnapshotVersion is the version of the snapshot file format.
+const AlertsCacheSnapshotVersion = 1
+
+type AlertsCacheSnapshot struct {
+	Version int                         `json:"version"`
+	SavedAt time.Time                   `json:"savedAt"`
+	Alerts  []*AlertsCacheSnapshotEntry `json:"alerts"`
+}
+
+// AlertsCacheStore keeps the alerts cache in the JSON snapshot file, so alerts keep their enrichment
+// across restarts even when their objects are deleted meanwhile.
+type AlertsCacheStore struct {
+	Path  string
+	Cache *LRUAlertsCache
+
+	// saveMutex serializes the periodic save of Run with the final save on shutdown
+	saveMutex sync.Mutex
+}
+
+func NewAlertsCacheStore(path string, cache *LRUAlertsCache) *AlertsCacheStore {
+	return &AlertsCacheStore{
+		Path:  path,
+		Cache: cache,
+	}
+}
+
+// Load restores the cache from the snapshot file, a missing file is not an error.
+func (store *AlertsCacheStore) Load() error {
+	data, err := ioutil.ReadFile(store.Path)
+	if os.IsNotExist(err) {
+		rlog.Infof("Alerts cache: no snapshot %s yet", store.Path)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read alerts cache snapshot %s: %s", store.Path, err)
+	}
+
+	snapshot := &AlertsCacheSnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return fmt.Errorf("cannot parse alerts cache snapshot %s: %s", store.Path, err)
+	}
+	if snapshot.Version != AlertsCacheSnapshotVersion {
+		return fmt.Errorf("unsupported alerts cache snapshot %s version %d", store.Path, snapshot.Version)
+	}
+
+	restored := store.Cache.Restore(snapshot.Alerts)
+	rlog.Infof("Alerts cache: restored %d of %d alerts from snapshot %s saved at %s",
+		restored, len(snapshot.Alerts), store.Path, snapshot.SavedAt.Format(time.RFC3339))
+
+	return nil
+}
+
+// Save writes the cache snapshot to the file.
+func (store *AlertsCacheStore) Save() error {
+	store.saveMutex.Lock()
+	defer store.saveMutex.Unlock()
+
+	snapshot := &AlertsCacheSnapshot{
+		Version: AlertsCacheSnapshotVersion,
+		SavedAt: time.Now(),
+		Alerts:  store.Cache.Snapshot(),
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("cannot dump alerts cache snapshot: %s", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(store.Path), 0755); err != nil {
+		return fmt.Errorf("cannot create alerts cache snapshot dir: %s", err)
+	}
+
+	// Write and sync the temporary file first, so a crash will not leave a broken snapshot
+	tmpPath := store.Path + ".tmp"
+	if err := writeFileSync(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("cannot write %s: %s", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, store.Path); err != nil {
+		return fmt.Errorf("cannot rename %s: %s", tmpPath, err)
+	}
+
+	rlog.Debugf("Alerts cache: saved %d alerts to snapshot %s", len(snapshot.Alerts), store.Path)
+
+	return nil
+}
+
+// writeFileSync is ioutil.WriteFile which flushes the file to the disk before closing.
+func writeFileSync(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Run saves the cache snapshot every interval until stopCh is closed.
+func (store *AlertsCacheStore) Run(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if err := store.Save(); err != nil {
+				rlog.Errorf("Alerts cache: %s", err)
+			}
+		}
+	}
+}
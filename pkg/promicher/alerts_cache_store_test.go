@@ -0,0 +1,94 @@
+package promicher
+
+import (
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAlertsCacheStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshots", "alerts-cache.json")
+
+	now := time.Now()
+	cache := NewLRUAlertsCache(10, time.Hour)
+	cache.Set("old", Alert{Labels: map[string]string{"alertname": "Old"}})
+	cache.Set("recent", Alert{Labels: map[string]string{"alertname": "Recent"}, Annotations: map[string]string{"runbook": "https://runbooks/recent"}})
+
+	if err := NewAlertsCacheStore(path, cache).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("restores entries", func(t *testing.T) {
+		restoredCache := NewLRUAlertsCache(10, time.Hour)
+		if err := NewAlertsCacheStore(path, restoredCache).Load(); err != nil {
+			t.Fatal(err)
+		}
+
+		alert, hasKey := restoredCache.Get("recent")
+		if !hasKey {
+			t.Fatal("expected restored alert")
+		}
+		if alert.Labels["alertname"] != "Recent" || alert.Annotations["runbook"] != "https://runbooks/recent" {
+			t.Errorf("unexpected restored alert %v %v", alert.Labels, alert.Annotations)
+		}
+
+		keys := []string{}
+		for _, entry := range restoredCache.Snapshot() {
+			keys = append(keys, entry.Fingerprint)
+		}
+		if !reflect.DeepEqual(keys, []string{"recent", "old"}) {
+			t.Errorf("expected the order of the used entries, got %v", keys)
+		}
+	})
+
+	t.Run("skips expired entries and entries over the limit", func(t *testing.T) {
+		restoredCache := NewLRUAlertsCache(1, time.Hour)
+		restoredCache.now = func() time.Time { return now.Add(2 * time.Hour) }
+		if err := NewAlertsCacheStore(path, restoredCache).Load(); err != nil {
+			t.Fatal(err)
+		}
+		if restoredCache.Len() != 0 {
+			t.Errorf("expected expired entries to be skipped, got %d entries", restoredCache.Len())
+		}
+
+		restoredCache = NewLRUAlertsCache(1, time.Hour)
+		if err := NewAlertsCacheStore(path, restoredCache).Load(); err != nil {
+			t.Fatal(err)
+		}
+		if _, hasKey := restoredCache.Get("recent"); !hasKey || restoredCache.Len() != 1 {
+			t.Errorf("expected only the most recent entry, got %d entries", restoredCache.Len())
+		}
+	})
+
+	t.Run("missing snapshot is not an error", func(t *testing.T) {
+		if err := NewAlertsCacheStore(filepath.Join(t.TempDir(), "missing.json"), NewLRUAlertsCache(1, 0)).Load(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("concurrent saves leave a valid snapshot", func(t *testing.T) {
+		store := NewAlertsCacheStore(filepath.Join(t.TempDir(), "alerts-cache.json"), cache)
+
+		wg := sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := store.Save(); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		restoredCache := NewLRUAlertsCache(10, time.Hour)
+		if err := NewAlertsCacheStore(store.Path, restoredCache).Load(); err != nil {
+			t.Fatal(err)
+		}
+		if restoredCache.Len() != 2 {
+			t.Errorf("expected 2 restored entries, got %d", restoredCache.Len())
+		}
+	})
+}
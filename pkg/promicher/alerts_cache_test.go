@@ -0,0 +1,104 @@
+package promicher
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func cachedAlert(name string) Alert {
+	return Alert{Labels: map[string]string{"alertname": name}}
+}
+
+func TestLRUAlertsCacheEviction(t *testing.T) {
+	cache := NewLRUAlertsCache(2, 0)
+	cache.Set("first", cachedAlert("First"))
+	cache.Set("second", cachedAlert("Second"))
+
+	// first is used after second, so second is the least recently used one
+	if _, hasKey := cache.Get("first"); !hasKey {
+		t.Fatal("expected first alert")
+	}
+	cache.Set("third", cachedAlert("Third"))
+
+	if _, hasKey := cache.Get("second"); hasKey {
+		t.Error("expected the least recently used alert to be evicted")
+	}
+	for _, key := range []string{"first", "third"} {
+		if _, hasKey := cache.Get(key); !hasKey {
+			t.Errorf("expected %s alert", key)
+		}
+	}
+
+	// Set of the present key updates the alert without eviction
+	cache.Set("first", cachedAlert("Updated"))
+	if alert, _ := cache.Get("first"); alert.Labels["alertname"] != "Updated" {
+		t.Errorf("expected updated alert, got %v", alert.Labels)
+	}
+
+	expected := AlertsCacheStats{Hits: 4, Misses: 1, Evictions: 1, Entries: 2}
+	if stats := cache.Stats(); stats != expected {
+		t.Errorf("expected stats %+v, got %+v", expected, stats)
+	}
+}
+
+func TestLRUAlertsCacheTTL(t *testing.T) {
+	now := time.Now()
+	cache := NewLRUAlertsCache(10, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	cache.Set("old", cachedAlert("Old"))
+	now = now.Add(30 * time.Second)
+	cache.Set("recent", cachedAlert("Recent"))
+
+	now = now.Add(30 * time.Second)
+	if _, hasKey := cache.Get("old"); hasKey {
+		t.Error("expected the old alert to expire")
+	}
+	if _, hasKey := cache.Get("recent"); !hasKey {
+		t.Error("expected the recent alert")
+	}
+
+	// Expired entries are dropped on Set without Get
+	now = now.Add(time.Minute)
+	cache.Set("new", cachedAlert("New"))
+	if cache.Len() != 1 {
+		t.Errorf("expected only the new alert, got %d entries", cache.Len())
+	}
+
+	expected := AlertsCacheStats{Hits: 1, Misses: 1, Expirations: 2, Entries: 1}
+	if stats := cache.Stats(); stats != expected {
+		t.Errorf("expected stats %+v, got %+v", expected, stats)
+	}
+}
+
+func TestLRUAlertsCacheConcurrentAccess(t *testing.T) {
+	cache := NewLRUAlertsCache(50, time.Hour)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				key := fmt.Sprintf("alert-%d", (worker*200+j)%100)
+				cache.Set(key, cachedAlert(key))
+				cache.Get(key)
+				cache.Stats()
+				if j%50 == 0 {
+					cache.Snapshot()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	stats := cache.Stats()
+	if stats.Entries != 50 || cache.Len() != 50 {
+		t.Errorf("expected 50 entries, got %d", stats.Entries)
+	}
+	if stats.Hits+stats.Misses != 8*200 {
+		t.Errorf("expected %d lookups, got %d hits and %d misses", 8*200, stats.Hits, stats.Misses)
+	}
+}
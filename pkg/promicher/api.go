@@ -0,0 +1,26 @@
+package promicher
+
+import (
+	"fmt"
+)
+
+// APIVersion is a version of Alertmanager alerts API.
+type APIVersion string
+
+const (
+	APIv1 APIVersion = "v1"
+	APIv2 APIVersion = "v2"
+)
+
+func ParseAPIVersion(version string) (APIVersion, error) {
+	switch APIVersion(version) {
+	case APIv1, APIv2:
+		return APIVersion(version), nil
+	}
+
+	return "", fmt.Errorf("unsupported alertmanager API version '%s': expected %s or %s", version, APIv1, APIv2)
+}
+
+func (version APIVersion) AlertsPath() string {
+	return fmt.Sprintf("/api/%s/alerts", version)
+}
@@ -0,0 +1,82 @@
+package promicher
+
+import (
+	"fmt"
+	"github.com/romana/rlog"
+	"io/ioutil"
+	"os"
+	"sigs.k8s.io/yaml"
+	"time"
+)
+
+// Config is the promicher rules file.
+type Config struct {
+	Rules   []*Rule   `json:"rules"`
+	Targets []*Target `json:"targets,omitempty"`
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config %s: %s", path, err)
+	}
+
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("cannot parse config %s: %s", path, err)
+	}
+
+	for i, rule := range config.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%d", i)
+		}
+		if err := rule.Compile(); err != nil {
+			return nil, fmt.Errorf("bad config %s: %s", path, err)
+		}
+	}
+
+	if len(config.Targets) == 0 {
+		config.Targets = DefaultTargets
+	}
+	config.Targets, err = SortTargets(config.Targets)
+	if err != nil {
+		return nil, fmt.Errorf("bad config %s: %s", path, err)
+	}
+
+	return config, nil
+}
+
+// WatchConfigFile calls onChange every time the file modification time or size changes until stopCh is closed.
+func WatchConfigFile(path string, interval time.Duration, stopCh <-chan struct{}, onChange func()) {
+	var lastModTime time.Time
+	var lastSize int64
+
+	if info, err := os.Stat(path); err == nil {
+		lastModTime = info.ModTime()
+		lastSize = info.Size()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			info, err := os.Stat(path)
+			if err != nil {
+				rlog.Errorf("Cannot stat config %s: %s", path, err)
+				continue
+			}
+
+			if !info.ModTime().Equal(lastModTime) || info.Size() != lastSize {
+				lastModTime = info.ModTime()
+				lastSize = info.Size()
+
+				rlog.Infof("Config %s changed", path)
+				onChange()
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package promicher
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DiffAlerts describes labels and annotations added, changed or removed by the enrichment of every alert.
+// Enriched alerts are matched with original alerts by the fingerprint of original labels,
+// an original alert without the enriched one is reported as dropped.
+func DiffAlerts(before, after []Alert) string {
+	var lines []string
+
+	afterByFingerprint := make(map[string][]Alert)
+	for _, alert := range after {
+		fingerprint := alert.SourceFingerprint()
+		afterByFingerprint[fingerprint] = append(afterByFingerprint[fingerprint], alert)
+	}
+
+	for i := range before {
+		lines = append(lines, fmt.Sprintf("alert #%d %s:", i, before[i].Labels["alertname"]))
+
+		fingerprint := before[i].Fingerprint()
+		matched := afterByFingerprint[fingerprint]
+		if len(matched) == 0 {
+			lines = append(lines, "  (dropped)")
+			continue
+		}
+		afterByFingerprint[fingerprint] = matched[1:]
+
+		changes := diffDataMap(string(LabelsData), before[i].Labels, matched[0].Labels)
+		changes = append(changes, diffDataMap(string(AnnotationsData), before[i].Annotations, matched[0].Annotations)...)
+		if len(changes) == 0 {
+			changes = []string{"  (not changed)"}
+		}
+
+		lines = append(lines, changes...)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func diffDataMap(prefix string, before, after map[string]string) []string {
+	keysSet := make(map[string]bool)
+	for k := range before {
+		keysSet[k] = true
+	}
+	for k := range after {
+		keysSet[k] = true
+	}
+
+	keys := make([]string, 0, len(keysSet))
+	for k := range keysSet {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var res []string
+	for _, k := range keys {
+		oldValue, hadKey := before[k]
+		newValue, hasKey := after[k]
+
+		switch {
+		case !hadKey:
+			res = append(res, fmt.Sprintf("  + %s.%s=%q", prefix, k, newValue))
+		case !hasKey:
+			res = append(res, fmt.Sprintf("  - %s.%s=%q", prefix, k, oldValue))
+		case oldValue != newValue:
+			res = append(res, fmt.Sprintf("  ~ %s.%s=%q -> %q", prefix, k, oldValue, newValue))
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,124 @@
+package promicher
+
+import (
+	"fmt"
+	"github.com/flant/promicher/pkg/kube"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"strings"
+)
+
+// LoadErrorReason classifies errors of loading kubernetes objects.
+type LoadErrorReason string
+
+const (
+	NotFound        LoadErrorReason = "not_found"
+	Forbidden       LoadErrorReason = "forbidden"
+	Timeout         LoadErrorReason = "timeout"
+	UnsupportedKind LoadErrorReason = "unsupported_kind"
+	UnknownError    LoadErrorReason = "unknown"
+)
+
+// LoadError is an error of loading the kubernetes object related to the alert.
+type LoadError struct {
+	Reason   LoadErrorReason
+	Resource *KubeResourceInfo
+	Err      error
+}
+
+func (err *LoadError) Error() string {
+	return fmt.Sprintf("cannot load kube %s: %s: %s", err.Resource.CacheId(), err.Reason, err.Err)
+}
+
+// NewLoadError classifies the error of kube.GetObject.
+func NewLoadError(resource *KubeResourceInfo, err error) *LoadError {
+	cause := err
+	reason := UnknownError
+
+	// Informers caches are filled with list requests, so their errors are the causes of not synced caches
+	if notSyncedErr, ok := err.(*kube.InformerNotSyncedError); ok {
+		reason = Timeout
+		if notSyncedErr.Err != nil {
+			cause = notSyncedErr.Err
+		}
+	}
+
+	switch {
+	case errors.IsForbidden(cause) || errors.IsUnauthorized(cause):
+		reason = Forbidden
+	case errors.IsTimeout(cause) || errors.IsServerTimeout(cause):
+		reason = Timeout
+	case meta.IsNoMatchError(cause):
+		reason = UnsupportedKind
+	case errors.IsNotFound(cause) && reason != Timeout:
+		reason = NotFound
+	}
+
+	return &LoadError{Reason: reason, Resource: resource, Err: err}
+}
+
+// ErrorPolicy is what to do with the alert when kubernetes objects related to it cannot be loaded
+// for other reasons than the object is not found.
+type ErrorPolicy string
+
+const (
+	// ForwardUnenriched forwards the alert enriched with the data loaded, or not enriched at all.
+	ForwardUnenriched ErrorPolicy = "forward"
+	// FailBatch fails the whole alerts batch, so Prometheus sends it again later.
+	FailBatch ErrorPolicy = "fail"
+)
+
+// FailedAlertPolicy is what to do with the alert which fails to enrich, e.g. because of a merge conflict.
+// Other alerts of the batch are forwarded anyway.
+type FailedAlertPolicy string
+
+const (
+	// ForwardFailedAlert forwards the failed alert unchanged.
+	ForwardFailedAlert FailedAlertPolicy = "forward"
+	// DropFailedAlert drops the failed alert.
+	DropFailedAlert FailedAlertPolicy = "drop"
+)
+
+// MergeError is an error of merging kubernetes data into the alert, e.g. conflicting values with error-on-conflict.
+type MergeError struct {
+	Resource *KubeResourceInfo
+	Err      error
+}
+
+func (err *MergeError) Error() string {
+	return fmt.Sprintf("cannot merge %s data into alert: %s", err.Resource.CacheId(), err.Err)
+}
+
+// FailureReason classifies the error of enriching the alert for metrics:
+// load error reasons, "merge_error" or "unknown".
+func FailureReason(err error) string {
+	switch typedErr := err.(type) {
+	case *LoadError:
+		return string(typedErr.Reason)
+	case *MergeError:
+		return "merge_error"
+	}
+	return string(UnknownError)
+}
+
+// Enrichment statuses written to the status annotation.
+const (
+	StatusEnriched = "enriched"
+	StatusPartial  = "partial"
+	StatusCached   = "cached"
+	StatusFailed   = "failed"
+)
+
+// FormatStatus formats the status with load errors, e.g. "partial: forbidden on namespace/shop".
+func FormatStatus(status string, loadErrors []*LoadError) string {
+	if len(loadErrors) == 0 {
+		return status
+	}
+
+	reasons := make([]string, 0, len(loadErrors))
+	for _, loadErr := range loadErrors {
+		reasons = append(reasons, fmt.Sprintf("%s on %s", loadErr.Reason, loadErr.Resource.CacheId()))
+	}
+
+	return fmt.Sprintf("%s: %s", status, strings.Join(reasons, ", "))
+}
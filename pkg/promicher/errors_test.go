@@ -0,0 +1,54 @@
+package promicher
+
+import (
+	"fmt"
+	"github.com/flant/promicher/pkg/kube"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"testing"
+)
+
+func TestNewLoadError(t *testing.T) {
+	pods := schema.GroupResource{Resource: "pods"}
+
+	tests := []struct {
+		name           string
+		err            error
+		expectedReason LoadErrorReason
+	}{
+		{"not found", errors.NewNotFound(pods, "web"), NotFound},
+		{"forbidden", errors.NewForbidden(pods, "web", fmt.Errorf("denied")), Forbidden},
+		{"unauthorized", errors.NewUnauthorized("expired token"), Forbidden},
+		{"server timeout", errors.NewServerTimeout(pods, "list", 1), Timeout},
+		{"not synced", &kube.InformerNotSyncedError{Resource: "pods"}, Timeout},
+		{"not synced as forbidden", &kube.InformerNotSyncedError{Resource: "pods", Err: errors.NewForbidden(pods, "", fmt.Errorf("denied"))}, Forbidden},
+		{"unsupported kind", &meta.NoKindMatchError{GroupKind: schema.GroupKind{Kind: "Unknown"}}, UnsupportedKind},
+		{"unknown", fmt.Errorf("connection refused"), UnknownError},
+	}
+
+	resource := &KubeResourceInfo{Namespace: "shop", Kind: "Pod", Name: "web"}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if reason := NewLoadError(resource, test.err).Reason; reason != test.expectedReason {
+				t.Errorf("expected reason %s, got %s", test.expectedReason, reason)
+			}
+		})
+	}
+}
+
+func TestFormatStatus(t *testing.T) {
+	loadErrors := []*LoadError{
+		{Reason: Forbidden, Resource: &KubeResourceInfo{Kind: "Namespace", Name: "shop"}},
+		{Reason: NotFound, Resource: &KubeResourceInfo{Namespace: "shop", Kind: "ReplicaSet", Name: "web"}},
+	}
+
+	if status := FormatStatus(StatusEnriched, nil); status != "enriched" {
+		t.Errorf("expected 'enriched', got '%s'", status)
+	}
+
+	expected := "partial: forbidden on namespace/shop, not_found on ns/shop replicaset/web"
+	if status := FormatStatus(StatusPartial, loadErrors); status != expected {
+		t.Errorf("expected '%s', got '%s'", expected, status)
+	}
+}
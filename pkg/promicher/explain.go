@@ -0,0 +1,124 @@
+package promicher
+
+import (
+	"fmt"
+	"sort"
+)
+
+// AlertExplanation describes how the alert is enriched.
+type AlertExplanation struct {
+	// Target is the object the alert is about, nil when no target matches the alert labels.
+	Target *KubeResourceInfo `json:"target"`
+	// Objects are the target, its owners and namespaces in the order they were walked.
+	Objects []*ExplainedObject `json:"objects"`
+	// OwnerChain is the chain of first owners from the farthest owner to the target object.
+	OwnerChain string `json:"ownerChain,omitempty"`
+	// Status is the enrichment status with the errors met while loading objects.
+	Status string `json:"status,omitempty"`
+	// Selections are all keys selected by rules from the objects, including ones overridden on merge.
+	Selections []*Selection `json:"selections"`
+	// Alert is the enriched alert.
+	Alert *Alert `json:"alert"`
+}
+
+type ExplainedObject struct {
+	Object string `json:"object"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Selection is a key selected by a rule from an object.
+type Selection struct {
+	Key       string   `json:"key"`
+	Value     string   `json:"value"`
+	To        DataKind `json:"to"`
+	Object    string   `json:"object"`
+	From      DataKind `json:"from"`
+	SourceKey string   `json:"sourceKey"`
+	Pattern   string   `json:"pattern"`
+	Rule      string   `json:"rule"`
+}
+
+// AddObject records the walked object, explanation may be nil.
+func (explanation *AlertExplanation) AddObject(resource *KubeResourceInfo, err error) {
+	if explanation == nil {
+		return
+	}
+
+	object := &ExplainedObject{Object: resource.CacheId()}
+	if err != nil {
+		object.Error = err.Error()
+	}
+	explanation.Objects = append(explanation.Objects, object)
+}
+
+// AddSelections records keys selected by the rule from the object, explanation may be nil.
+func (explanation *AlertExplanation) AddSelections(kind, namespace, name string, rule *Rule, data map[string]string, sources map[string]SelectedKey) {
+	if explanation == nil {
+		return
+	}
+
+	object := (&KubeResourceInfo{Namespace: namespace, Kind: kind, Name: name}).CacheId()
+
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		explanation.Selections = append(explanation.Selections, &Selection{
+			Key:       k,
+			Value:     data[k],
+			To:        rule.To,
+			Object:    object,
+			From:      rule.From,
+			SourceKey: sources[k].SourceKey,
+			Pattern:   sources[k].Pattern,
+			Rule:      rule.Name,
+		})
+	}
+}
+
+// ExplainAlert enriches the alert as ProcessAlert does, but neither reads nor updates the alerts cache,
+// and records every step of the enrichment.
+func (promicher *Promicher) ExplainAlert(alert Alert) (*AlertExplanation, error) {
+	config := promicher.Config()
+
+	explanation := &AlertExplanation{
+		Objects:    make([]*ExplainedObject, 0),
+		Selections: make([]*Selection, 0),
+	}
+
+	explanation.Target = alert.KubeTargetResourceInfo(promicher.Kube, config.Targets)
+	if explanation.Target != nil {
+		selector := promicher.NewDataSelector(&alert, config.Rules)
+		selector.Explanation = explanation
+
+		data, err := LoadKubeResourceData(promicher.Kube, explanation.Target, TargetDepth, selector)
+		if _, isLoadErr := err.(*LoadError); err != nil && !isLoadErr {
+			return nil, fmt.Errorf("cannot enrich alert: %s", err)
+		}
+
+		if data != nil {
+			alert.Labels, alert.Annotations, err = MergeData(&alert, data.Values)
+			if err != nil {
+				return nil, fmt.Errorf("cannot merge %s data into alert: %s", explanation.Target.CacheId(), err)
+			}
+			promicher.annotateOwnerChain(&alert, selector)
+		}
+
+		explanation.OwnerChain = selector.OwnerChain()
+
+		status := StatusEnriched
+		if data == nil {
+			status = StatusFailed
+		} else if len(selector.LoadErrors) > 0 {
+			status = StatusPartial
+		}
+		explanation.Status = FormatStatus(status, selector.LoadErrors)
+	}
+
+	explanation.Alert = &alert
+
+	return explanation, nil
+}
@@ -4,13 +4,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/flant/promicher/pkg/kube"
+	"github.com/flant/promicher/pkg/metrics"
 	"github.com/romana/rlog"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sort"
 )
 
+// KubeResourceData is metadata selected from the object, its owners and its namespace.
 type KubeResourceData struct {
-	Labels      map[string]string
-	Annotations map[string]string
+	// Values in the order they were walked.
+	Values []*EnrichedValue
 }
 
 func (data *KubeResourceData) String() string {
@@ -22,246 +26,154 @@ func (data *KubeResourceData) String() string {
 	return string(bytes)
 }
 
-func LoadKubeResourceData(
-	kube *kube.Kube,
-	namespace, kind, resourceName string,
-	labelsPatterns []string,
-	annotationsPatterns []string,
-) (*KubeResourceData, error) {
-	switch kind {
-	case "Pod":
-		return LoadPodData(kube, namespace, resourceName, labelsPatterns, annotationsPatterns)
-	case "Deployment":
-		return LoadDeploymentData(kube, namespace, resourceName, labelsPatterns, annotationsPatterns)
-	case "ReplicaSet":
-		return LoadReplicasetData(kube, namespace, resourceName, labelsPatterns, annotationsPatterns)
-	case "StatefulSet":
-		return LoadStatefulsetData(kube, namespace, resourceName, labelsPatterns, annotationsPatterns)
-	case "DaemonSet":
-		return LoadDaemonsetData(kube, namespace, resourceName, labelsPatterns, annotationsPatterns)
-	case "Job":
-		return LoadJobData(kube, namespace, resourceName, labelsPatterns, annotationsPatterns)
-	case "CronJob":
-		return LoadCronJobData(kube, namespace, resourceName, labelsPatterns, annotationsPatterns)
-	case "PersistentVolumeClaim":
-		return LoadPersistentVolumeClaimData(kube, namespace, resourceName, labelsPatterns, annotationsPatterns)
-	case "Namespace":
-		return LoadNamespaceData(kube, namespace, labelsPatterns, annotationsPatterns)
+// Add appends values of other data, other may be nil.
+func (data *KubeResourceData) Add(other *KubeResourceData) {
+	if other != nil {
+		data.Values = append(data.Values, other.Values...)
 	}
-
-	rlog.Warnf("Unsupported kind '%s' for kube resource '%s/%s' info loader: ignoring resource data", kind, namespace, resourceName)
-
-	return &KubeResourceData{}, nil
 }
 
-func LoadOwnerResourcesData(kube *kube.Kube, namespace string, ownerReferences []meta_v1.OwnerReference, labelsPatterns, annotationsPatterns []string) (*KubeResourceData, error) {
-	res := &KubeResourceData{}
-
-	for _, ownerRef := range ownerReferences {
-		ownerResourceData, err := LoadKubeResourceData(kube, namespace, ownerRef.Kind, ownerRef.Name, labelsPatterns, annotationsPatterns)
-		if err != nil {
-			return nil, err
+// LoadKubeResourceData loads data of the object of any kind, including custom resources, from informers caches.
+// Depth is the distance of the object from the alert, see EnrichedValue.
+// When the object cannot be loaded, the *LoadError is recorded in the selector and returned.
+// Objects related to the loaded object which cannot be loaded are only recorded in the selector.
+func LoadKubeResourceData(kube *kube.Kube, resource *KubeResourceInfo, depth int, selector *DataSelector) (*KubeResourceData, error) {
+	obj, err := kube.GetObject(resource.APIVersion, resource.Kind, resource.Namespace, resource.Name)
+	selector.Explanation.AddObject(resource, err)
+	if err != nil {
+		loadErr := NewLoadError(resource, err)
+		selector.LoadErrors = append(selector.LoadErrors, loadErr)
+		metrics.KubeLoadErrors.WithLabelValues(resource.Kind, string(loadErr.Reason)).Inc()
+
+		if loadErr.Reason == NotFound {
+			rlog.Debugf("Kube %s is not found", resource.CacheId())
+		} else {
+			rlog.Errorf("error fetching kube %s: %s", resource.CacheId(), err)
 		}
-
-		res.Labels = MergeDataMap(res.Labels, ownerResourceData.Labels)
-		res.Annotations = MergeDataMap(res.Annotations, ownerResourceData.Annotations)
+		return nil, loadErr
 	}
 
-	return res, nil
-}
-
-func LoadObjectData(kube *kube.Kube, namespace string, obj *meta_v1.ObjectMeta, labelsPatterns, annotationsPatterns []string) (*KubeResourceData, error) {
-	res, err := MakeObjectData(obj, labelsPatterns, annotationsPatterns)
+	res, err := LoadObjectData(kube, obj, depth, selector)
 	if err != nil {
 		return nil, err
 	}
 
-	ownersData, err := LoadOwnerResourcesData(kube, namespace, obj.OwnerReferences, labelsPatterns, annotationsPatterns)
-	if err != nil {
-		return nil, err
-	}
-	res.Labels = MergeDataMap(res.Labels, ownersData.Labels)
-	res.Annotations = MergeDataMap(res.Annotations, ownersData.Annotations)
-
-	if namespace != "" {
-		namespaceData, err := LoadNamespaceData(kube, namespace, labelsPatterns, annotationsPatterns)
-		if err != nil {
-			return nil, err
-		}
-		res.Labels = MergeDataMap(res.Labels, namespaceData.Labels)
-		res.Annotations = MergeDataMap(res.Annotations, namespaceData.Annotations)
-	}
+	rlog.Debugf("Loaded %s kube data:\n%s", resource.CacheId(), res.String())
 
 	return res, nil
 }
 
-func MakeObjectData(obj *meta_v1.ObjectMeta, labelsPatterns, annotationsPatterns []string) (*KubeResourceData, error) {
+// LoadOwnerResourcesData loads data of owners at the depth, owners deeper than selector.MaxOwnerDepth
+// and owners already walked for the alert are skipped.
+func LoadOwnerResourcesData(kube *kube.Kube, namespace string, ownerReferences []meta_v1.OwnerReference, depth int, selector *DataSelector) (*KubeResourceData, error) {
 	res := &KubeResourceData{}
 
-	labels, err := SelectData(obj.Labels, labelsPatterns)
-	if err != nil {
-		return nil, err
+	if len(ownerReferences) > 0 && depth-TargetDepth > selector.MaxOwnerDepth {
+		rlog.Debugf("Owners deeper than %d are not loaded", selector.MaxOwnerDepth)
+		return res, nil
 	}
-	res.Labels = MergeDataMap(res.Labels, labels)
 
-	annotations, err := SelectData(obj.Annotations, annotationsPatterns)
-	if err != nil {
-		return nil, err
-	}
-	res.Annotations = MergeDataMap(res.Annotations, annotations)
+	for _, ownerRef := range ownerReferences {
+		owner := &KubeResourceInfo{
+			Namespace:  namespace,
+			APIVersion: ownerRef.APIVersion,
+			Kind:       ownerRef.Kind,
+			Name:       ownerRef.Name,
+		}
 
-	return res, nil
-}
+		if !selector.Visit(owner) {
+			rlog.Warnf("Owner references cycle: %s is already walked", owner.CacheId())
+			continue
+		}
 
-func LoadNamespaceData(kube *kube.Kube, resourceName string, labelsPatterns, annotationsPatterns []string) (*KubeResourceData, error) {
-	resource, err := kube.Client.CoreV1().Namespaces().Get(resourceName, meta_v1.GetOptions{})
-	if err != nil {
-		rlog.Errorf("error fetching kube ns/%s %s: %s", resourceName, err)
-		return nil, nil
-	}
+		ownerResourceData, err := LoadKubeResourceData(kube, owner, depth, selector)
+		if _, isLoadErr := err.(*LoadError); isLoadErr {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
 
-	res, err := LoadObjectData(kube, "", &resource.ObjectMeta, labelsPatterns, annotationsPatterns)
-	if err != nil {
-		return nil, err
+		res.Add(ownerResourceData)
 	}
 
-	rlog.Debugf("Loaded ns/%s kube data:\n%s", resourceName, res.String())
-
 	return res, nil
 }
 
-func LoadPodData(kube *kube.Kube, namespace, resourceName string, labelsPatterns, annotationsPatterns []string) (*KubeResourceData, error) {
-	resource, err := kube.Client.CoreV1().Pods(namespace).Get(resourceName, meta_v1.GetOptions{})
-	if err != nil {
-		rlog.Errorf("error fetching kube pod/%s from ns/%s: %s", resourceName, namespace, err)
-		return nil, nil
-	}
+func LoadObjectData(kube *kube.Kube, obj *unstructured.Unstructured, depth int, selector *DataSelector) (*KubeResourceData, error) {
+	kind := obj.GetKind()
+	namespace := obj.GetNamespace()
 
-	res, err := LoadObjectData(kube, namespace, &resource.ObjectMeta, labelsPatterns, annotationsPatterns)
-	if err != nil {
-		return nil, err
+	// Owners are marked when they are found, the target object is marked here
+	selector.Visit(&KubeResourceInfo{Namespace: namespace, Kind: kind, Name: obj.GetName()})
+	if depth != NamespaceDepth {
+		selector.AddToOwnerChain(depth, kind, obj.GetName())
 	}
 
-	rlog.Debugf("Loaded pod/%s kube data from ns/%s:\n%s", resourceName, namespace, res.String())
-
-	return res, nil
-}
-
-func LoadDeploymentData(kube *kube.Kube, namespace, resourceName string, labelsPatterns []string, annotationsPatterns []string) (*KubeResourceData, error) {
-	resource, err := kube.Client.AppsV1().Deployments(namespace).Get(resourceName, meta_v1.GetOptions{})
-	if err != nil {
-		rlog.Errorf("error fetching kube deployment/%s from ns/%s: %s", resourceName, namespace, err)
-		return nil, nil
-	}
-
-	res, err := LoadObjectData(kube, namespace, &resource.ObjectMeta, labelsPatterns, annotationsPatterns)
+	res, err := MakeObjectData(kube, namespace, kind, obj, depth, selector)
 	if err != nil {
 		return nil, err
 	}
 
-	rlog.Debugf("Loaded deployment/%s ns/%s kube data:\n%s", resourceName, namespace, res.String())
-
-	return res, nil
-}
-
-func LoadReplicasetData(kube *kube.Kube, namespace, resourceName string, labelsPatterns []string, annotationsPatterns []string) (*KubeResourceData, error) {
-	resource, err := kube.Client.AppsV1().ReplicaSets(namespace).Get(resourceName, meta_v1.GetOptions{})
-	if err != nil {
-		rlog.Errorf("error fetching kube replicaset/%s from ns/%s: %s", resourceName, namespace, err)
-		return nil, nil
-	}
-
-	res, err := LoadObjectData(kube, namespace, &resource.ObjectMeta, labelsPatterns, annotationsPatterns)
-	if err != nil {
-		return nil, err
-	}
-
-	rlog.Debugf("Loaded replicaset/%s kube data from ns/%s:\n%s", resourceName, namespace, res.String())
-
-	return res, nil
-}
-
-func LoadStatefulsetData(kube *kube.Kube, namespace, resourceName string, labelsPatterns []string, annotationsPatterns []string) (*KubeResourceData, error) {
-	resource, err := kube.Client.AppsV1().StatefulSets(namespace).Get(resourceName, meta_v1.GetOptions{})
-	if err != nil {
-		rlog.Errorf("error fetching kube statefulset/%s from ns/%s: %s", resourceName, namespace, err)
-		return nil, nil
-	}
-
-	res, err := LoadObjectData(kube, namespace, &resource.ObjectMeta, labelsPatterns, annotationsPatterns)
+	ownersData, err := LoadOwnerResourcesData(kube, namespace, obj.GetOwnerReferences(), depth+1, selector)
 	if err != nil {
 		return nil, err
 	}
+	res.Add(ownersData)
 
-	rlog.Debugf("Loaded statefulset/%s kube data from ns/%s:\n%s", resourceName, namespace, res.String())
-
-	return res, nil
-}
-
-func LoadDaemonsetData(kube *kube.Kube, namespace, resourceName string, labelsPatterns []string, annotationsPatterns []string) (*KubeResourceData, error) {
-	resource, err := kube.Client.AppsV1().DaemonSets(namespace).Get(resourceName, meta_v1.GetOptions{})
-	if err != nil {
-		rlog.Errorf("error fetching kube daemonset/%s from ns/%s: %s", resourceName, namespace, err)
-		return nil, nil
-	}
-
-	res, err := LoadObjectData(kube, namespace, &resource.ObjectMeta, labelsPatterns, annotationsPatterns)
-	if err != nil {
-		return nil, err
+	// The namespace is the same for the object and its owners, so it is loaded once
+	if namespace != "" && selector.VisitNamespace(namespace) {
+		namespaceData, err := LoadKubeResourceData(kube, &KubeResourceInfo{Kind: "Namespace", Name: namespace}, NamespaceDepth, selector)
+		if _, isLoadErr := err.(*LoadError); err != nil && !isLoadErr {
+			return nil, err
+		}
+		res.Add(namespaceData)
 	}
 
-	rlog.Debugf("Loaded daemonset/%s kube data from ns/%s:\n%s", resourceName, namespace, res.String())
-
 	return res, nil
 }
 
-func LoadJobData(kube *kube.Kube, namespace, resourceName string, labelsPatterns []string, annotationsPatterns []string) (*KubeResourceData, error) {
-	resource, err := kube.Client.BatchV1().Jobs(namespace).Get(resourceName, meta_v1.GetOptions{})
-	if err != nil {
-		rlog.Errorf("error fetching kube job/%s from ns/%s: %s", resourceName, namespace, err)
-		return nil, nil
-	}
-
-	res, err := LoadObjectData(kube, namespace, &resource.ObjectMeta, labelsPatterns, annotationsPatterns)
-	if err != nil {
-		return nil, err
-	}
-
-	rlog.Debugf("Loaded job/%s kube data from ns/%s:\n%s", resourceName, namespace, res.String())
-
-	return res, nil
-}
+// MakeObjectData selects the object metadata with all rules matching the object and the alert.
+func MakeObjectData(kube *kube.Kube, namespace, kind string, obj *unstructured.Unstructured, depth int, selector *DataSelector) (*KubeResourceData, error) {
+	res := &KubeResourceData{}
 
-func LoadCronJobData(kube *kube.Kube, namespace, resourceName string, labelsPatterns []string, annotationsPatterns []string) (*KubeResourceData, error) {
-	resource, err := kube.Client.BatchV1beta1().CronJobs(namespace).Get(resourceName, meta_v1.GetOptions{})
-	if err != nil {
-		rlog.Errorf("error fetching kube cronjob/%s from ns/%s: %s", resourceName, namespace, err)
-		return nil, nil
+	namespaceLabels := obj.GetLabels()
+	if kind != "Namespace" {
+		namespaceLabels = selector.NamespaceLabels(kube, namespace)
 	}
 
-	res, err := LoadObjectData(kube, namespace, &resource.ObjectMeta, labelsPatterns, annotationsPatterns)
-	if err != nil {
-		return nil, err
-	}
+	object := (&KubeResourceInfo{Namespace: namespace, Kind: kind, Name: obj.GetName()}).CacheId()
 
-	rlog.Debugf("Loaded cronjob/%s kube data from ns/%s:\n%s", resourceName, namespace, res.String())
+	for _, rule := range selector.Rules {
+		if !rule.Matches(kind, namespaceLabels, selector.Alert) {
+			continue
+		}
 
-	return res, nil
-}
+		data, sources, err := rule.Select(obj, selector.Alert)
+		if err != nil {
+			return nil, err
+		}
 
-func LoadPersistentVolumeClaimData(kube *kube.Kube, namespace, resourceName string, labelsPatterns []string, annotationsPatterns []string) (*KubeResourceData, error) {
-	resource, err := kube.Client.CoreV1().PersistentVolumeClaims(namespace).Get(resourceName, meta_v1.GetOptions{})
-	if err != nil {
-		rlog.Errorf("error fetching kube persistentvolumeclaim/%s from ns/%s: %s", resourceName, namespace, err)
-		return nil, nil
-	}
+		selector.Explanation.AddSelections(kind, namespace, obj.GetName(), rule, data, sources)
 
-	res, err := LoadObjectData(kube, namespace, &resource.ObjectMeta, labelsPatterns, annotationsPatterns)
-	if err != nil {
-		return nil, err
+		keys := make([]string, 0, len(data))
+		for k := range data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		// Values of earlier rules go first and take precedence over later rules values of the same object
+		for _, k := range keys {
+			res.Values = append(res.Values, &EnrichedValue{
+				To:     rule.To,
+				Key:    k,
+				Value:  data[k],
+				Depth:  depth,
+				Object: object,
+				Policy: rule.MergePolicy(k),
+			})
+		}
 	}
 
-	rlog.Debugf("Loaded persistentvolumeclaim/%s kube data from ns/%s:\n%s", resourceName, namespace, res.String())
-
 	return res, nil
 }
@@ -0,0 +1,153 @@
+package promicher
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MergePolicy decides which value of the key wins when the alert, the target object,
+// its owners and its namespace have different values.
+type MergePolicy string
+
+const (
+	// AlertWins keeps the alert value, otherwise the nearest object value wins.
+	AlertWins MergePolicy = "alert-wins"
+	// ResourceWins replaces the alert value with the alert target object value,
+	// values of owners and the namespace do not replace the alert value.
+	ResourceWins MergePolicy = "resource-wins"
+	// NearestWins replaces the alert value with the nearest object value, the first object wins at equal depth.
+	NearestWins MergePolicy = "nearest-wins"
+	// FarthestWins takes the value of the farthest source: the namespace, then owners, then the object, then the alert.
+	FarthestWins MergePolicy = "farthest-wins"
+	// ErrorOnConflict fails the alert enrichment when sources have different values.
+	ErrorOnConflict MergePolicy = "error-on-conflict"
+)
+
+var MergePolicies = []MergePolicy{AlertWins, ResourceWins, NearestWins, FarthestWins, ErrorOnConflict}
+
+// DefaultMergePolicy is the previous behavior: alert labels are never overwritten, nearer objects win.
+const DefaultMergePolicy = AlertWins
+
+// TargetDepth is the depth of the alert target object values.
+const TargetDepth = 1
+
+// NamespaceDepth is the depth of namespace values, the namespace is farther than any owner.
+const NamespaceDepth = 1000
+
+func ParseMergePolicy(s string) (MergePolicy, error) {
+	for _, policy := range MergePolicies {
+		if string(policy) == s {
+			return policy, nil
+		}
+	}
+	return "", fmt.Errorf("bad merge policy '%s': expected one of %v", s, MergePolicies)
+}
+
+// EnrichedValue is the value selected by a rule from an object at the depth:
+// 1 is the target object, owners are deeper by one with every owner reference, the namespace is at NamespaceDepth.
+type EnrichedValue struct {
+	To     DataKind    `json:"to"`
+	Key    string      `json:"key"`
+	Value  string      `json:"value"`
+	Depth  int         `json:"depth"`
+	Object string      `json:"object"`
+	Policy MergePolicy `json:"policy"`
+}
+
+// MergeData returns alert labels and annotations merged with the values.
+// When rules with different policies select the key, the policy of the first selection
+// in the walk order applies: the nearest object, the earliest rule.
+func MergeData(alert *Alert, values []*EnrichedValue) (map[string]string, map[string]string, error) {
+	labels, err := mergeValues(LabelsData, alert.Labels, values)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	annotations, err := mergeValues(AnnotationsData, alert.Annotations, values)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return labels, annotations, nil
+}
+
+func mergeValues(to DataKind, alertData map[string]string, values []*EnrichedValue) (map[string]string, error) {
+	keysValues := make(map[string][]*EnrichedValue)
+	for _, value := range values {
+		if value.To == to {
+			keysValues[value.Key] = append(keysValues[value.Key], value)
+		}
+	}
+
+	res := make(map[string]string)
+	for k, v := range alertData {
+		res[k] = v
+	}
+
+	for key, candidates := range keysValues {
+		alertValue, hasAlertValue := alertData[key]
+
+		value, err := candidates[0].Policy.resolve(candidates, alertValue, hasAlertValue)
+		if err != nil {
+			return nil, fmt.Errorf("%s key '%s': %s", to, key, err)
+		}
+		res[key] = value
+	}
+
+	return res, nil
+}
+
+func (policy MergePolicy) resolve(candidates []*EnrichedValue, alertValue string, hasAlertValue bool) (string, error) {
+	byDepth := make([]*EnrichedValue, len(candidates))
+	copy(byDepth, candidates)
+	sort.SliceStable(byDepth, func(i, j int) bool {
+		return byDepth[i].Depth < byDepth[j].Depth
+	})
+
+	nearest := byDepth[0]
+	farthest := byDepth[len(byDepth)-1]
+	for _, candidate := range byDepth {
+		// Values of the same object go in the rules order
+		if candidate.Depth == farthest.Depth {
+			farthest = candidate
+			break
+		}
+	}
+
+	switch policy {
+	case ResourceWins:
+		if nearest.Depth != TargetDepth && hasAlertValue {
+			return alertValue, nil
+		}
+		return nearest.Value, nil
+	case NearestWins:
+		return nearest.Value, nil
+	case FarthestWins:
+		return farthest.Value, nil
+	case ErrorOnConflict:
+		conflict := hasAlertValue && alertValue != nearest.Value
+		for _, candidate := range byDepth {
+			if candidate.Value != nearest.Value {
+				conflict = true
+			}
+		}
+
+		if conflict {
+			var sources []string
+			if hasAlertValue {
+				sources = append(sources, fmt.Sprintf("alert=%q", alertValue))
+			}
+			for _, candidate := range byDepth {
+				sources = append(sources, fmt.Sprintf("%s=%q", candidate.Object, candidate.Value))
+			}
+			return "", fmt.Errorf("conflicting values: %s", strings.Join(sources, ", "))
+		}
+		return nearest.Value, nil
+	default:
+		if hasAlertValue {
+			return alertValue, nil
+		}
+		return nearest.Value, nil
+	}
+}
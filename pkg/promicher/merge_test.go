@@ -0,0 +1,114 @@
+package promicher
+
+import (
+	"github.com/flant/promicher/pkg/kube/fake"
+	"testing"
+)
+
+func TestMergeData(t *testing.T) {
+	values := func(policy MergePolicy, podValue, namespaceValue string) []*EnrichedValue {
+		return []*EnrichedValue{
+			{To: LabelsData, Key: "severity", Value: podValue, Depth: TargetDepth, Object: "ns/shop Pod/web", Policy: policy},
+			{To: LabelsData, Key: "severity", Value: "deployment", Depth: TargetDepth + 2, Object: "ns/shop Deployment/web", Policy: policy},
+			{To: LabelsData, Key: "severity", Value: namespaceValue, Depth: NamespaceDepth, Object: "Namespace/shop", Policy: policy},
+		}
+	}
+
+	tests := []struct {
+		policy        MergePolicy
+		alertValue    string
+		expectedValue string
+		expectedError bool
+	}{
+		{AlertWins, "critical", "critical", false},
+		{AlertWins, "", "pod", false},
+		{NearestWins, "critical", "pod", false},
+		{NearestWins, "", "pod", false},
+		{ResourceWins, "critical", "pod", false},
+		{FarthestWins, "critical", "namespace", false},
+		{ErrorOnConflict, "critical", "", true},
+		{ErrorOnConflict, "", "", true},
+	}
+
+	for _, test := range tests {
+		alert := &Alert{Labels: map[string]string{"alertname": "Test"}}
+		if test.alertValue != "" {
+			alert.Labels["severity"] = test.alertValue
+		}
+
+		labels, _, err := MergeData(alert, values(test.policy, "pod", "namespace"))
+		if test.expectedError {
+			if err == nil {
+				t.Errorf("%s alert '%s': expected error, got %v", test.policy, test.alertValue, labels)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s alert '%s': %s", test.policy, test.alertValue, err)
+			continue
+		}
+		if labels["severity"] != test.expectedValue || labels["alertname"] != "Test" {
+			t.Errorf("%s alert '%s': expected severity '%s', got %v", test.policy, test.alertValue, test.expectedValue, labels)
+		}
+	}
+
+	t.Run("error-on-conflict accepts equal values", func(t *testing.T) {
+		sameValues := []*EnrichedValue{
+			{To: LabelsData, Key: "team", Value: "shop", Depth: TargetDepth, Object: "ns/shop Pod/web", Policy: ErrorOnConflict},
+			{To: LabelsData, Key: "team", Value: "shop", Depth: NamespaceDepth, Object: "Namespace/shop", Policy: ErrorOnConflict},
+		}
+		labels, _, err := MergeData(&Alert{Labels: map[string]string{"team": "shop"}}, sameValues)
+		if err != nil || labels["team"] != "shop" {
+			t.Errorf("expected team 'shop', got %v, %v", labels, err)
+		}
+	})
+
+	t.Run("owner value without target object value", func(t *testing.T) {
+		expected := map[MergePolicy]string{AlertWins: "critical", ResourceWins: "critical", NearestWins: "statefulset"}
+		for policy, expectedValue := range expected {
+			ownersValues := []*EnrichedValue{
+				{To: LabelsData, Key: "severity", Value: "statefulset", Depth: TargetDepth + 1, Object: "ns/shop StatefulSet/db", Policy: policy},
+				{To: LabelsData, Key: "severity", Value: "operator", Depth: TargetDepth + 1, Object: "ns/shop Postgres/db", Policy: policy},
+				{To: LabelsData, Key: "severity", Value: "namespace", Depth: NamespaceDepth, Object: "Namespace/shop", Policy: policy},
+			}
+			labels, _, err := MergeData(&Alert{Labels: map[string]string{"severity": "critical"}}, ownersValues)
+			if err != nil || labels["severity"] != expectedValue {
+				t.Errorf("%s: expected severity '%s', got %v, %v", policy, expectedValue, labels, err)
+			}
+		}
+	})
+}
+
+func TestRuleMergeKeysAndPrefix(t *testing.T) {
+	rule := &Rule{
+		Name:      "prefixed",
+		From:      LabelsData,
+		Keys:      []string{"team", "severity"},
+		Prefix:    "k8s_",
+		Merge:     FarthestWins,
+		MergeKeys: map[string]MergePolicy{"k8s_severity": ResourceWins},
+	}
+	if err := rule.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := fake.WithMetadata(fake.NewObject("Pod", "shop", "web"), map[string]string{"team": "shop", "severity": "warning"}, nil)
+	data, _, err := rule.Select(obj, &Alert{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 2 || data["k8s_team"] != "shop" || data["k8s_severity"] != "warning" {
+		t.Errorf("expected prefixed keys, got %v", data)
+	}
+
+	if policy := rule.MergePolicy("k8s_team"); policy != FarthestWins {
+		t.Errorf("expected %s policy of k8s_team, got %s", FarthestWins, policy)
+	}
+	if policy := rule.MergePolicy("k8s_severity"); policy != ResourceWins {
+		t.Errorf("expected %s policy of k8s_severity, got %s", ResourceWins, policy)
+	}
+
+	if err := (&Rule{Name: "bad", From: LabelsData, Keys: []string{".*"}, Merge: "random-wins"}).Compile(); err == nil {
+		t.Error("expected error of bad merge policy")
+	}
+}
@@ -0,0 +1,124 @@
+package promicher
+
+import (
+	"fmt"
+	"github.com/romana/rlog"
+	"regexp"
+	"strings"
+)
+
+// PatternTemplateSeparator separates the key regular expression and the key template of the pattern.
+const PatternTemplateSeparator = "=>"
+
+// KeyGroup is the name of the regular expression group used as the resulting key when the pattern has no template.
+const KeyGroup = "key"
+
+// Pattern is a compiled key pattern "REGEXP" or "REGEXP=>TEMPLATE".
+// The resulting key is the TEMPLATE with $1, ${name} expanded to the matched groups,
+// without the template it is the "key" named group, the last group or the whole key.
+type Pattern struct {
+	// Source is the pattern as it was specified.
+	Source string
+
+	rgxp     *regexp.Regexp
+	template string
+	keyGroup int
+}
+
+func CompilePattern(source string) (*Pattern, error) {
+	expr := source
+	template := ""
+	if i := strings.LastIndex(source, PatternTemplateSeparator); i >= 0 {
+		expr = source[:i]
+		template = source[i+len(PatternTemplateSeparator):]
+		if template == "" {
+			return nil, fmt.Errorf("bad pattern '%s': empty key template", source)
+		}
+	}
+
+	rgxp, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("bad pattern '%s': %s", source, err)
+	}
+
+	return &Pattern{
+		Source:   source,
+		rgxp:     rgxp,
+		template: template,
+		keyGroup: rgxp.SubexpIndex(KeyGroup),
+	}, nil
+}
+
+// Apply matches the key and returns the resulting key, a match resulting in the empty key is not a match.
+func (pattern *Pattern) Apply(key string) (bool, string) {
+	matches := pattern.rgxp.FindStringSubmatchIndex(key)
+	if matches == nil {
+		rlog.Debugf("'%s' NOT MATCHED pattern '%s'", key, pattern.Source)
+		return false, ""
+	}
+
+	var res string
+	switch {
+	case pattern.template != "":
+		res = string(pattern.rgxp.ExpandString(nil, pattern.template, key, matches))
+	case pattern.keyGroup >= 0:
+		res = submatch(key, matches, pattern.keyGroup)
+	default:
+		res = submatch(key, matches, len(matches)/2-1)
+	}
+
+	if res == "" {
+		rlog.Debugf("'%s' MATCHED pattern '%s' with the empty key", key, pattern.Source)
+		return false, ""
+	}
+
+	rlog.Debugf("'%s' MATCHED pattern '%s' => '%s'", key, pattern.Source, res)
+
+	return true, res
+}
+
+func submatch(s string, matches []int, group int) string {
+	if matches[2*group] < 0 {
+		return ""
+	}
+	return s[matches[2*group]:matches[2*group+1]]
+}
+
+// PatternSet is the list of patterns compiled once and applied to keys of every object.
+type PatternSet []*Pattern
+
+func CompilePatterns(sources []string) (PatternSet, error) {
+	res := make(PatternSet, 0, len(sources))
+	for _, source := range sources {
+		pattern, err := CompilePattern(source)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, pattern)
+	}
+	return res, nil
+}
+
+// SelectedKey is the source of a selected key.
+type SelectedKey struct {
+	SourceKey string
+	Pattern   string
+}
+
+// Select returns data with keys matched by any pattern renamed to the resulting keys
+// and the source key and the pattern of every selected key.
+func (patterns PatternSet) Select(data map[string]string) (map[string]string, map[string]SelectedKey) {
+	res := make(map[string]string)
+	sources := make(map[string]SelectedKey)
+
+	for k, v := range data {
+		for _, pattern := range patterns {
+			if ok, newKey := pattern.Apply(k); ok {
+				res[newKey] = v
+				sources[newKey] = SelectedKey{SourceKey: k, Pattern: pattern.Source}
+			}
+		}
+	}
+
+	return res, sources
+}
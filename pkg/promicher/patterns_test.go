@@ -0,0 +1,45 @@
+package promicher
+
+import (
+	"testing"
+)
+
+func TestPatternApply(t *testing.T) {
+	tests := []struct {
+		pattern     string
+		key         string
+		expectedOk  bool
+		expectedKey string
+	}{
+		{"hello/(.*)", "hello/world", true, "world"},
+		{"(.*)/(path)", "some.host.io/path", true, "path"},
+		{"some.host.io/.*", "some.host.io/path", true, "some.host.io/path"},
+		{"(?P<key>.*)/path", "some.host.io/path", true, "some.host.io"},
+		{"(?P<key>[a-z]+)/(.*)", "app/name", true, "app"},
+		{`(?P<host>[a-z]+)\..*/(path)=>${host}_${2}`, "some.host.io/path", true, "some_path"},
+		{"example.com/(.*)=>team_$1", "example.com/lead", true, "team_lead"},
+		{"other.io/(.*)", "example.com/lead", false, ""},
+		{"example.com/(x)?", "example.com/", false, ""},
+	}
+
+	for _, test := range tests {
+		pattern, err := CompilePattern(test.pattern)
+		if err != nil {
+			t.Fatalf("pattern '%s': %s", test.pattern, err)
+		}
+
+		ok, key := pattern.Apply(test.key)
+		if ok != test.expectedOk || key != test.expectedKey {
+			t.Errorf("pattern '%s' key '%s': expected %v '%s', got %v '%s'",
+				test.pattern, test.key, test.expectedOk, test.expectedKey, ok, key)
+		}
+	}
+}
+
+func TestCompilePatternsErrors(t *testing.T) {
+	for _, source := range []string{"(unclosed", "valid/(.*)=>", "[=>$1"} {
+		if _, err := CompilePatterns([]string{"ok", source}); err == nil {
+			t.Errorf("expected error for pattern '%s'", source)
+		}
+	}
+}
@@ -1,78 +1,250 @@
 package promicher
 
 import (
+	"fmt"
 	"github.com/flant/promicher/pkg/kube"
+	"github.com/flant/promicher/pkg/metrics"
 	"github.com/romana/rlog"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Promicher struct {
 	Kube        *kube.Kube
-	AlertsCache map[string]Alert
-	Labels      []string
-	Annotations []string
+	AlertsCache AlertsCache
+	// MaxOwnerDepth limits owner references followed from the alert target object.
+	MaxOwnerDepth int
+	// OwnerChainAnnotation is the alert annotation to write the owner chain of the target object to, disabled when empty.
+	OwnerChainAnnotation string
+	// StatusAnnotation is the alert annotation to write the enrichment status to, disabled when empty.
+	StatusAnnotation string
+	// ErrorPolicy is what to do with alerts whose objects cannot be loaded.
+	ErrorPolicy ErrorPolicy
+	// FailedAlertPolicy is what to do with alerts which fail to enrich.
+	FailedAlertPolicy FailedAlertPolicy
+
+	configMutex sync.RWMutex
+	config      *Config
 }
 
-func NewPromicher(kube *kube.Kube, labels, annotations []string) *Promicher {
+func NewPromicher(kube *kube.Kube, alertsCache AlertsCache, config *Config) *Promicher {
 	return &Promicher{
-		Kube:        kube,
-		AlertsCache: make(map[string]Alert),
-		Labels:      labels,
-		Annotations: annotations,
+		Kube:              kube,
+		AlertsCache:       alertsCache,
+		MaxOwnerDepth:     DefaultMaxOwnerDepth,
+		ErrorPolicy:       ForwardUnenriched,
+		FailedAlertPolicy: ForwardFailedAlert,
+		config:            config,
 	}
 }
 
+// Config returns current enrichment rules and targets.
+func (promicher *Promicher) Config() *Config {
+	promicher.configMutex.RLock()
+	defer promicher.configMutex.RUnlock()
+
+	return promicher.config
+}
+
+// SetConfig replaces enrichment rules and targets, alerts being processed keep using the previous config.
+func (promicher *Promicher) SetConfig(config *Config) {
+	promicher.configMutex.Lock()
+	defer promicher.configMutex.Unlock()
+
+	promicher.config = config
+}
+
+// ProcessAlert enriches the alert. Enriched alerts are cached by the fingerprint of their original labels:
+// resolved alerts get the enrichment they fired with, and alerts whose objects are gone get the last enrichment.
 func (promicher *Promicher) ProcessAlert(alert Alert) (Alert, error) {
-	resource := alert.KubeTargetResourceInfo()
+	config := promicher.Config()
+
+	resource := alert.KubeTargetResourceInfo(promicher.Kube, config.Targets)
+	fingerprint := alert.Fingerprint()
+
+	// The target of a resolved alert may be gone, e.g. a node found by the address, it gets the cached enrichment anyway
+	if alert.IsResolved(time.Now()) {
+		if cachedAlert, hasKey := promicher.AlertsCache.Get(fingerprint); hasKey {
+			kind, target := "", "no target"
+			if resource != nil {
+				kind, target = resource.Kind, resource.CacheId()
+			}
+			rlog.Debugf("Cache hit for resolved alert %s of '%s':\n%s", fingerprint, target, cachedAlert.String())
+
+			metrics.AlertsProcessed.WithLabelValues(kind, "cached").Inc()
+			alert = withCachedEnrichment(alert, cachedAlert)
+			promicher.annotateStatus(&alert, StatusCached)
+			return alert, nil
+		}
+	}
+
 	if resource == nil {
+		metrics.AlertsProcessed.WithLabelValues("", "no_target").Inc()
 		return alert, nil
 	}
 
-	if !alert.EndsAt.IsZero() {
-		if cachedAlert, hasKey := promicher.AlertsCache[resource.CacheId()]; hasKey {
-			rlog.Debugf("Cache hit for resource '%s':\n%s", resource.CacheId(), cachedAlert.String())
+	selector := promicher.NewDataSelector(&alert, config.Rules)
 
-			return cachedAlert, nil
-		}
+	loadStart := time.Now()
+	data, err := LoadKubeResourceData(promicher.Kube, resource, TargetDepth, selector)
+	metrics.KubeLoadDuration.WithLabelValues(resource.Kind).Observe(time.Since(loadStart).Seconds())
+	if _, isLoadErr := err.(*LoadError); err != nil && !isLoadErr {
+		metrics.AlertsProcessed.WithLabelValues(resource.Kind, "error").Inc()
+		return Alert{}, err
 	}
 
-	data, err := LoadKubeResourceData(promicher.Kube, resource.Namespace, resource.Kind, resource.Name, promicher.Labels, promicher.Annotations)
-	if err != nil {
-		return Alert{}, err
+	if failedLoadErrors := selector.FailedLoadErrors(); len(failedLoadErrors) > 0 && promicher.ErrorPolicy == FailBatch {
+		metrics.AlertsProcessed.WithLabelValues(resource.Kind, "error").Inc()
+		return Alert{}, failedLoadErrors[0]
 	}
 
 	if data == nil {
-		if cachedAlert, hasKey := promicher.AlertsCache[resource.CacheId()]; hasKey {
-			rlog.Debugf("Cache hit for resource '%s':\n%s", resource.CacheId(), cachedAlert.String())
+		if cachedAlert, hasKey := promicher.AlertsCache.Get(fingerprint); hasKey {
+			rlog.Debugf("Cache hit for alert %s of '%s':\n%s", fingerprint, resource.CacheId(), cachedAlert.String())
 
-			return cachedAlert, nil
+			metrics.AlertsProcessed.WithLabelValues(resource.Kind, "cache_fallback").Inc()
+			alert = withCachedEnrichment(alert, cachedAlert)
+			promicher.annotateStatus(&alert, FormatStatus(StatusCached, selector.LoadErrors))
+			return alert, nil
 		}
+
+		metrics.AlertsProcessed.WithLabelValues(resource.Kind, "unresolved").Inc()
+		promicher.annotateStatus(&alert, FormatStatus(StatusFailed, selector.LoadErrors))
 	} else {
-		alert.Labels = MergeDataMap(alert.Labels, data.Labels)
-		alert.Annotations = MergeDataMap(alert.Annotations, data.Annotations)
+		alert.Labels, alert.Annotations, err = MergeData(&alert, data.Values)
+		if err != nil {
+			metrics.AlertsProcessed.WithLabelValues(resource.Kind, "error").Inc()
+			return Alert{}, &MergeError{Resource: resource, Err: err}
+		}
+		promicher.annotateOwnerChain(&alert, selector)
+
+		outcome := StatusEnriched
+		if len(selector.LoadErrors) > 0 {
+			outcome = StatusPartial
+		}
+		promicher.annotateStatus(&alert, FormatStatus(outcome, selector.LoadErrors))
+
+		promicher.AlertsCache.Set(fingerprint, alert)
 
-		promicher.AlertsCache[resource.CacheId()] = alert
+		rlog.Debugf("Cache updated for alert %s of '%s':\n%s", fingerprint, resource.CacheId(), alert.String())
 
-		rlog.Debugf("Cache updated for alert '%s':\n%s", resource.CacheId(), alert.String())
+		metrics.AlertsProcessed.WithLabelValues(resource.Kind, outcome).Inc()
 	}
 
 	return alert, nil
 }
 
-func (promicher *Promicher) ProcessData(dataBytes []byte) ([]byte, error) {
-	alerts, err := ParseAlerts(dataBytes)
-	if err != nil {
-		return nil, err
+// withCachedEnrichment returns the alert with labels of the cached enriched alert, so Alertmanager matches them,
+// and with cached annotations overridden by the alert own annotations. Timestamps and other fields are kept.
+func withCachedEnrichment(alert Alert, cachedAlert Alert) Alert {
+	annotations := make(map[string]string)
+	for k, v := range cachedAlert.Annotations {
+		annotations[k] = v
+	}
+	for k, v := range alert.Annotations {
+		annotations[k] = v
+	}
+
+	alert.Labels = cachedAlert.Labels
+	alert.Annotations = annotations
+
+	return alert
+}
+
+// NewDataSelector makes the selector of the alert data with the rules and the promicher settings.
+func (promicher *Promicher) NewDataSelector(alert *Alert, rules []*Rule) *DataSelector {
+	selector := NewDataSelector(alert, rules)
+	selector.MaxOwnerDepth = promicher.MaxOwnerDepth
+	return selector
+}
+
+// annotateStatus writes the enrichment status to the alert status annotation.
+func (promicher *Promicher) annotateStatus(alert *Alert, status string) {
+	if promicher.StatusAnnotation == "" {
+		return
 	}
 
-	res := make([]Alert, 0)
+	annotations := make(map[string]string)
+	for k, v := range alert.Annotations {
+		annotations[k] = v
+	}
+	annotations[promicher.StatusAnnotation] = status
+
+	alert.Annotations = annotations
+}
+
+// annotateOwnerChain writes the owner chain walked by the selector to the alert annotation unless the alert has it.
+func (promicher *Promicher) annotateOwnerChain(alert *Alert, selector *DataSelector) {
+	if promicher.OwnerChainAnnotation == "" {
+		return
+	}
+
+	ownerChain := selector.OwnerChain()
+	if ownerChain == "" {
+		return
+	}
+
+	if _, hasKey := alert.Annotations[promicher.OwnerChainAnnotation]; !hasKey {
+		alert.Annotations[promicher.OwnerChainAnnotation] = ownerChain
+	}
+}
+
+// ProcessAlerts enriches alerts one by one and returns alerts to forward and the number of failed alerts.
+// An alert which fails to enrich is forwarded unchanged or dropped according to the failed alert policy,
+// so it does not block other alerts of the batch. The batch fails only with the FailBatch error policy.
+func (promicher *Promicher) ProcessAlerts(alerts []Alert) ([]Alert, int, error) {
+	res := make([]Alert, 0, len(alerts))
+	failures := make([]string, 0)
 
 	for _, alert := range alerts {
 		newAlert, err := promicher.ProcessAlert(alert)
-		if err != nil {
-			return nil, err
+		if err == nil {
+			newAlert.sourceFingerprint = alert.Fingerprint()
+			res = append(res, newAlert)
+			continue
+		}
+
+		if _, isLoadErr := err.(*LoadError); isLoadErr && promicher.ErrorPolicy == FailBatch {
+			return nil, len(failures) + 1, fmt.Errorf("alert %s: %s", alert.Labels["alertname"], err)
+		}
+
+		failures = append(failures, fmt.Sprintf("%s: %s", alert.Labels["alertname"], err))
+
+		if promicher.FailedAlertPolicy == DropFailedAlert {
+			metrics.AlertsFailed.WithLabelValues("dropped", FailureReason(err)).Inc()
+			continue
 		}
-		res = append(res, newAlert)
+
+		metrics.AlertsFailed.WithLabelValues("forwarded", FailureReason(err)).Inc()
+		promicher.annotateStatus(&alert, StatusFailed)
+		res = append(res, alert)
+	}
+
+	if len(failures) > 0 {
+		rlog.Errorf("%d of %d alerts failed to enrich, %d alerts forwarded, '%s' failed alert policy:\n%s",
+			len(failures), len(alerts), len(res), promicher.FailedAlertPolicy, strings.Join(failures, "\n"))
+	}
+
+	stats := promicher.AlertsCache.Stats()
+	rlog.Debugf("Alerts cache stats: %d entries, %d hits, %d misses, %d evictions, %d expirations",
+		stats.Entries, stats.Hits, stats.Misses, stats.Evictions, stats.Expirations)
+
+	return res, len(failures), nil
+}
+
+// ProcessData enriches alerts of the payload and returns the payload to forward and the number of failed alerts.
+func (promicher *Promicher) ProcessData(dataBytes []byte, version APIVersion) ([]byte, int, error) {
+	alerts, err := ParseAlerts(dataBytes, version)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	res, failed, err := promicher.ProcessAlerts(alerts)
+	if err != nil {
+		return nil, failed, err
 	}
 
-	return DumpAlerts(res)
+	data, err := DumpAlerts(res, version)
+	return data, failed, err
 }
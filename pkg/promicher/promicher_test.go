@@ -0,0 +1,591 @@
+package promicher
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/flant/promicher/pkg/kube"
+	"github.com/flant/promicher/pkg/kube/fake"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestKube(t *testing.T, objects ...*unstructured.Unstructured) *kube.Kube {
+	t.Helper()
+	return newTestKubeWithOptions(t, fake.Options{}, objects...)
+}
+
+// newTestKubeWithOptions makes the fake cluster with the options,
+// informers which never sync make requests fail after 100ms.
+func newTestKubeWithOptions(t *testing.T, options fake.Options, objects ...*unstructured.Unstructured) *kube.Kube {
+	t.Helper()
+
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+
+	res, err := fake.NewKubeWithOptions(stopCh, options, objects...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.SyncTimeout = 100 * time.Millisecond
+	return res
+}
+
+func newTestPromicher(t *testing.T, kube *kube.Kube) *Promicher {
+	t.Helper()
+
+	rules, err := NewPatternsRules([]string{".*"}, []string{".*"}, DefaultMergePolicy, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewPromicher(kube, NewLRUAlertsCache(100, 0), &Config{Rules: rules, Targets: DefaultTargets})
+}
+
+func processAlert(t *testing.T, promicher *Promicher, alert map[string]interface{}) Alert {
+	t.Helper()
+
+	data, err := json.Marshal([]interface{}{alert})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resData, failed, err := promicher.ProcessData(data, APIv2)
+	if err != nil || failed != 0 {
+		t.Fatalf("ProcessData: %d failed alerts, error %v", failed, err)
+	}
+
+	res, err := ParseAlerts(resData, APIv2)
+	if err != nil {
+		t.Fatalf("cannot parse ProcessData result %s: %s", resData, err)
+	}
+	if len(res) != 1 {
+		t.Fatalf("expected 1 alert, got %d: %s", len(res), resData)
+	}
+	return res[0]
+}
+
+func TestProcessData(t *testing.T) {
+	promicher := newTestPromicher(t, newTestKube(t, fake.NewCluster()...))
+
+	tests := []struct {
+		name                string
+		labels              map[string]string
+		expectedLabels      map[string]string
+		expectedAnnotations map[string]string
+	}{
+		{
+			name:   "deployment pod merges pod, owners and namespace, nearest object wins",
+			labels: map[string]string{"alertname": "PodCrashLooping", "namespace": fake.ClusterNamespace, "pod": fake.ClusterPod},
+			expectedLabels: map[string]string{
+				"alertname": "PodCrashLooping", "namespace": fake.ClusterNamespace, "pod": fake.ClusterPod,
+				"level": "pod", "app": "web", "pod-template-hash": "5d8f", "team": "shop-team",
+			},
+			expectedAnnotations: map[string]string{
+				"level": "pod", "runbook": "https://runbooks/web", "owner": "shop@example.com",
+			},
+		},
+		{
+			name:   "alert labels win over object labels",
+			labels: map[string]string{"alertname": "PodCrashLooping", "namespace": fake.ClusterNamespace, "pod": fake.ClusterPod, "level": "alert"},
+			expectedLabels: map[string]string{
+				"alertname": "PodCrashLooping", "namespace": fake.ClusterNamespace, "pod": fake.ClusterPod,
+				"level": "alert", "app": "web", "pod-template-hash": "5d8f", "team": "shop-team",
+			},
+			expectedAnnotations: map[string]string{
+				"level": "pod", "runbook": "https://runbooks/web", "owner": "shop@example.com",
+			},
+		},
+		{
+			name:   "cronjob pod merges job and cronjob",
+			labels: map[string]string{"alertname": "JobFailed", "namespace": fake.ClusterNamespace, "pod": fake.ClusterJobPod},
+			expectedLabels: map[string]string{
+				"alertname": "JobFailed", "namespace": fake.ClusterNamespace, "pod": fake.ClusterJobPod,
+				"level": "pod", "app": "backup", "team": "shop-team",
+			},
+			expectedAnnotations: map[string]string{
+				"level": "cronjob", "runbook": "https://runbooks/backup", "owner": "shop@example.com",
+			},
+		},
+		{
+			name:   "deployment",
+			labels: map[string]string{"alertname": "DeploymentUnavailable", "namespace": fake.ClusterNamespace, "deployment": fake.ClusterDeployment},
+			expectedLabels: map[string]string{
+				"alertname": "DeploymentUnavailable", "namespace": fake.ClusterNamespace, "deployment": fake.ClusterDeployment,
+				"level": "deployment", "app": "web", "team": "shop-team",
+			},
+			expectedAnnotations: map[string]string{
+				"level": "deployment", "runbook": "https://runbooks/web", "owner": "shop@example.com",
+			},
+		},
+		{
+			name:   "persistent volume claim",
+			labels: map[string]string{"alertname": "VolumeFull", "namespace": fake.ClusterNamespace, "persistentvolumeclaim": fake.ClusterPVC},
+			expectedLabels: map[string]string{
+				"alertname": "VolumeFull", "namespace": fake.ClusterNamespace, "persistentvolumeclaim": fake.ClusterPVC,
+				"level": "pvc", "app": "web", "team": "shop-team",
+			},
+			expectedAnnotations: map[string]string{
+				"level": "pvc", "owner": "shop@example.com",
+			},
+		},
+		{
+			name: "node exporter alert is resolved to the node by the instance address",
+			// The namespace label of the exporter does not make the alert about the namespace
+			labels: map[string]string{"alertname": "NodeFilesystemFull", "instance": fake.ClusterNodeIP + ":9100", "namespace": "monitoring"},
+			expectedLabels: map[string]string{
+				"alertname": "NodeFilesystemFull", "instance": fake.ClusterNodeIP + ":9100", "namespace": "monitoring",
+				"level": "node", "topology.kubernetes.io/zone": "zone-a",
+			},
+			expectedAnnotations: map[string]string{"level": "node"},
+		},
+		{
+			name: "scrape job label does not select a Job",
+			labels: map[string]string{
+				"alertname": "NodeFilesystemFull", "instance": fake.ClusterNodeIP + ":9100", "namespace": fake.ClusterNamespace, "job": fake.ClusterJob,
+			},
+			expectedLabels: map[string]string{
+				"alertname": "NodeFilesystemFull", "instance": fake.ClusterNodeIP + ":9100", "namespace": fake.ClusterNamespace, "job": fake.ClusterJob,
+				"level": "node", "topology.kubernetes.io/zone": "zone-a",
+			},
+			expectedAnnotations: map[string]string{"level": "node"},
+		},
+		{
+			name:   "kube-state-metrics job alert",
+			labels: map[string]string{"alertname": "KubeJobFailed", "namespace": fake.ClusterNamespace, "job_name": fake.ClusterJob, "job": "kube-state-metrics"},
+			expectedLabels: map[string]string{
+				"alertname": "KubeJobFailed", "namespace": fake.ClusterNamespace, "job_name": fake.ClusterJob, "job": "kube-state-metrics",
+				"level": "job", "app": "backup", "team": "shop-team",
+			},
+			expectedAnnotations: map[string]string{
+				"level": "cronjob", "runbook": "https://runbooks/backup", "owner": "shop@example.com",
+			},
+		},
+		{
+			name:   "kube-state-metrics node alert",
+			labels: map[string]string{"alertname": "NodeNotReady", "node": fake.ClusterNode},
+			expectedLabels: map[string]string{
+				"alertname": "NodeNotReady", "node": fake.ClusterNode,
+				"level": "node", "topology.kubernetes.io/zone": "zone-a",
+			},
+			expectedAnnotations: map[string]string{"level": "node"},
+		},
+		{
+			name:   "persistent volume alert without namespace",
+			labels: map[string]string{"alertname": "VolumeFailed", "persistentvolume": fake.ClusterPV},
+			expectedLabels: map[string]string{
+				"alertname": "VolumeFailed", "persistentvolume": fake.ClusterPV,
+				"level": "pv", "storage-tier": "ssd",
+			},
+			expectedAnnotations: map[string]string{"level": "pv"},
+		},
+		{
+			name:           "alert without target labels is not changed",
+			labels:         map[string]string{"alertname": "Watchdog"},
+			expectedLabels: map[string]string{"alertname": "Watchdog"},
+		},
+		{
+			name:           "alert about a missing object is not changed",
+			labels:         map[string]string{"alertname": "PodCrashLooping", "namespace": fake.ClusterNamespace, "pod": "missing"},
+			expectedLabels: map[string]string{"alertname": "PodCrashLooping", "namespace": fake.ClusterNamespace, "pod": "missing"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			alert := processAlert(t, promicher, map[string]interface{}{"labels": test.labels})
+
+			if !reflect.DeepEqual(alert.Labels, test.expectedLabels) {
+				t.Errorf("labels:\nexpected %v\ngot      %v", test.expectedLabels, alert.Labels)
+			}
+			if len(alert.Annotations) != 0 || len(test.expectedAnnotations) != 0 {
+				if !reflect.DeepEqual(alert.Annotations, test.expectedAnnotations) {
+					t.Errorf("annotations:\nexpected %v\ngot      %v", test.expectedAnnotations, alert.Annotations)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessDataCacheFallback(t *testing.T) {
+	promicher := newTestPromicher(t, newTestKube(t, fake.NewCluster()...))
+
+	labels := map[string]string{"alertname": "PodCrashLooping", "namespace": fake.ClusterNamespace, "pod": fake.ClusterPod}
+
+	enriched := processAlert(t, promicher, map[string]interface{}{"labels": labels})
+	if enriched.Labels["level"] != "pod" {
+		t.Fatalf("alert is not enriched: %v", enriched.Labels)
+	}
+
+	// The pod is deleted: the cluster has only its namespace now
+	promicher.Kube = newTestKube(t, fake.NewCluster()[0])
+
+	t.Run("firing alert falls back to the cached alert", func(t *testing.T) {
+		alert := processAlert(t, promicher, map[string]interface{}{"labels": labels})
+		if !reflect.DeepEqual(alert.Labels, enriched.Labels) {
+			t.Errorf("expected cached labels %v, got %v", enriched.Labels, alert.Labels)
+		}
+	})
+
+	t.Run("resolved alert uses the cached alert", func(t *testing.T) {
+		alert := processAlert(t, promicher, map[string]interface{}{"labels": labels, "endsAt": "2020-01-01T00:00:00Z"})
+		if !reflect.DeepEqual(alert.Labels, enriched.Labels) {
+			t.Errorf("expected cached labels %v, got %v", enriched.Labels, alert.Labels)
+		}
+	})
+
+	t.Run("alert without cached enrichment is not changed", func(t *testing.T) {
+		otherLabels := map[string]string{"alertname": "PodCrashLooping", "namespace": fake.ClusterNamespace, "pod": fake.ClusterJobPod}
+		alert := processAlert(t, promicher, map[string]interface{}{"labels": otherLabels})
+		if !reflect.DeepEqual(alert.Labels, otherLabels) {
+			t.Errorf("expected labels %v, got %v", otherLabels, alert.Labels)
+		}
+	})
+}
+
+func TestProcessDataOwnerChain(t *testing.T) {
+	// ReplicaSets owning each other make an owner references cycle
+	first := fake.WithMetadata(fake.NewObject("ReplicaSet", fake.ClusterNamespace, "first"), map[string]string{"first": "yes"}, nil)
+	second := fake.WithMetadata(fake.NewObject("ReplicaSet", fake.ClusterNamespace, "second"), map[string]string{"second": "yes"}, nil)
+	fake.OwnedBy(first, second)
+	fake.OwnedBy(second, first)
+	looped := fake.OwnedBy(fake.NewObject("Pod", fake.ClusterNamespace, "looped"), first)
+
+	promicher := newTestPromicher(t, newTestKube(t, append(fake.NewCluster(), first, second, looped)...))
+	promicher.OwnerChainAnnotation = "kube_owner_chain"
+
+	tests := []struct {
+		name                       string
+		pod                        string
+		maxOwnerDepth              int
+		expectedOwnerChain         string
+		expectedLabels             []string
+		expectedMissingAnnotations []string
+	}{
+		{
+			name:               "full chain",
+			pod:                fake.ClusterPod,
+			maxOwnerDepth:      DefaultMaxOwnerDepth,
+			expectedOwnerChain: "Deployment/web > ReplicaSet/web-5d8f > Pod/web-5d8f-x7k2",
+			expectedLabels:     []string{"team"},
+		},
+		{
+			name:                       "depth limit",
+			pod:                        fake.ClusterPod,
+			maxOwnerDepth:              1,
+			expectedOwnerChain:         "ReplicaSet/web-5d8f > Pod/web-5d8f-x7k2",
+			expectedLabels:             []string{"pod-template-hash", "team"},
+			expectedMissingAnnotations: []string{"runbook"},
+		},
+		{
+			name:               "cycle",
+			pod:                "looped",
+			maxOwnerDepth:      DefaultMaxOwnerDepth,
+			expectedOwnerChain: "ReplicaSet/second > ReplicaSet/first > Pod/looped",
+			expectedLabels:     []string{"first", "second", "team"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			promicher.MaxOwnerDepth = test.maxOwnerDepth
+			promicher.AlertsCache = NewLRUAlertsCache(100, 0)
+
+			alert := processAlert(t, promicher, map[string]interface{}{"labels": map[string]string{
+				"alertname": "PodCrashLooping", "namespace": fake.ClusterNamespace, "pod": test.pod,
+			}})
+
+			if ownerChain := alert.Annotations["kube_owner_chain"]; ownerChain != test.expectedOwnerChain {
+				t.Errorf("expected owner chain '%s', got '%s'", test.expectedOwnerChain, ownerChain)
+			}
+			for _, label := range test.expectedLabels {
+				if _, hasKey := alert.Labels[label]; !hasKey {
+					t.Errorf("expected label %s, got %v", label, alert.Labels)
+				}
+			}
+			for _, annotation := range test.expectedMissingAnnotations {
+				if _, hasKey := alert.Annotations[annotation]; hasKey {
+					t.Errorf("expected no annotation %s, got %v", annotation, alert.Annotations)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessDataResolvedAlertKeepsEnrichment(t *testing.T) {
+	promicher := newTestPromicher(t, newTestKube(t, fake.NewCluster()...))
+
+	crashLooping := map[string]string{"alertname": "PodCrashLooping", "namespace": fake.ClusterNamespace, "pod": fake.ClusterPod}
+	notReady := map[string]string{"alertname": "PodNotReady", "namespace": fake.ClusterNamespace, "pod": fake.ClusterPod, "team": "on-call"}
+
+	firing := processAlert(t, promicher, map[string]interface{}{"labels": crashLooping, "endsAt": "2999-01-01T00:00:00Z"})
+	processAlert(t, promicher, map[string]interface{}{"labels": notReady})
+
+	if firing.Labels["team"] != "shop-team" || firing.EndsAtRaw != "2999-01-01T00:00:00Z" {
+		t.Fatalf("firing alert with endsAt in the future is not enriched: %v %s", firing.Labels, firing.EndsAtRaw)
+	}
+
+	// The pod is deleted
+	promicher.Kube = newTestKube(t, fake.NewCluster()[0])
+
+	resolved := processAlert(t, promicher, map[string]interface{}{"labels": crashLooping, "endsAt": "2020-01-01T00:00:00Z"})
+	if !reflect.DeepEqual(resolved.Labels, firing.Labels) {
+		t.Errorf("expected labels of the firing alert %v, got %v", firing.Labels, resolved.Labels)
+	}
+	if resolved.EndsAtRaw != "2020-01-01T00:00:00Z" {
+		t.Errorf("expected endsAt of the resolved alert, got '%s'", resolved.EndsAtRaw)
+	}
+}
+
+func TestProcessDataResolvedAlertOfDeletedNode(t *testing.T) {
+	promicher := newTestPromicher(t, newTestKube(t, fake.NewCluster()...))
+
+	labels := map[string]string{"alertname": "NodeFilesystemFull", "instance": fake.ClusterNodeIP + ":9100"}
+	firing := processAlert(t, promicher, map[string]interface{}{"labels": labels})
+	if firing.Labels["level"] != "node" {
+		t.Fatalf("expected the firing alert enriched with the node, got %v", firing.Labels)
+	}
+
+	// The node is deleted, so its address resolves to no target
+	var objects []*unstructured.Unstructured
+	for _, obj := range fake.NewCluster() {
+		if obj.GetKind() != "Node" {
+			objects = append(objects, obj)
+		}
+	}
+	promicher.Kube = newTestKube(t, objects...)
+
+	resolved := processAlert(t, promicher, map[string]interface{}{"labels": labels, "endsAt": "2020-01-01T00:00:00Z"})
+	if !reflect.DeepEqual(resolved.Labels, firing.Labels) {
+		t.Errorf("expected labels of the firing alert %v, got %v", firing.Labels, resolved.Labels)
+	}
+}
+
+func TestProcessDataDeletedPodTombstone(t *testing.T) {
+	cluster := fake.NewCluster()
+	kube := newTestKubeWithOptions(t, fake.Options{TombstoneRetention: time.Hour}, cluster...)
+	promicher := newTestPromicher(t, kube)
+
+	var pod *unstructured.Unstructured
+	for _, obj := range cluster {
+		if obj.GetKind() == "Pod" && obj.GetName() == fake.ClusterPod {
+			pod = obj
+		}
+	}
+	if err := fake.DeleteObject(kube, pod); err != nil {
+		t.Fatal(err)
+	}
+
+	// The informer gets the delete event asynchronously
+	deadline := time.Now().Add(5 * time.Second)
+	for kube.Tombstones.Len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the tombstone of the deleted pod")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	alert := processAlert(t, promicher, map[string]interface{}{"labels": map[string]string{
+		"alertname": "PodOOMKilled", "namespace": fake.ClusterNamespace, "pod": fake.ClusterPod,
+	}})
+	if alert.Labels["level"] != "pod" || alert.Labels["pod-template-hash"] != "5d8f" || alert.Annotations["runbook"] != "https://runbooks/web" {
+		t.Errorf("expected the alert enriched with the deleted pod and its owners, got %v %v", alert.Labels, alert.Annotations)
+	}
+}
+
+func TestProcessDataStatusAnnotation(t *testing.T) {
+	orphan := fake.OwnedBy(fake.NewObject("Pod", fake.ClusterNamespace, "orphan"), fake.NewObject("ReplicaSet", fake.ClusterNamespace, "gone"))
+
+	promicher := newTestPromicher(t, newTestKube(t, append(fake.NewCluster(), orphan)...))
+	promicher.StatusAnnotation = "promicher_status"
+
+	tests := []struct {
+		name           string
+		pod            string
+		endsAt         string
+		expectedStatus string
+	}{
+		{
+			name:           "enriched",
+			pod:            fake.ClusterPod,
+			expectedStatus: StatusEnriched,
+		},
+		{
+			name:           "missing owner",
+			pod:            "orphan",
+			expectedStatus: "partial: not_found on ns/shop replicaset/gone",
+		},
+		{
+			name:           "missing target",
+			pod:            "missing",
+			expectedStatus: "failed: not_found on ns/shop pod/missing",
+		},
+		{
+			name:           "resolved alert from cache",
+			pod:            fake.ClusterPod,
+			endsAt:         "2020-01-01T00:00:00Z",
+			expectedStatus: StatusCached,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			alert := map[string]interface{}{"labels": map[string]string{
+				"alertname": "PodCrashLooping", "namespace": fake.ClusterNamespace, "pod": test.pod,
+			}}
+			if test.endsAt != "" {
+				alert["endsAt"] = test.endsAt
+			}
+
+			res := processAlert(t, promicher, alert)
+			if status := res.Annotations["promicher_status"]; status != test.expectedStatus {
+				t.Errorf("expected status '%s', got '%s'", test.expectedStatus, status)
+			}
+		})
+	}
+}
+
+func TestProcessDataLoadErrors(t *testing.T) {
+	canary := fake.OwnedBy(fake.NewObject("Pod", fake.ClusterNamespace, "canary"), fake.NewObject("Rollout", fake.ClusterNamespace, "canary"))
+	orphan := fake.OwnedBy(fake.NewObject("Pod", fake.ClusterNamespace, "orphan"), fake.NewObject("ReplicaSet", fake.ClusterNamespace, "gone"))
+	rollouts := schema.GroupResource{Group: "argoproj.io", Resource: "rollouts"}
+
+	tests := []struct {
+		name           string
+		listErr        error
+		expectedStatus string
+	}{
+		{
+			name:           "forbidden",
+			listErr:        errors.NewForbidden(rollouts, "", fmt.Errorf("denied")),
+			expectedStatus: "partial: forbidden on ns/shop rollout/canary",
+		},
+		{
+			name:           "server timeout",
+			listErr:        errors.NewServerTimeout(rollouts, "list", 1),
+			expectedStatus: "partial: timeout on ns/shop rollout/canary",
+		},
+		{
+			name:           "not synced",
+			listErr:        fmt.Errorf("connection refused"),
+			expectedStatus: "partial: timeout on ns/shop rollout/canary",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kube := newTestKubeWithOptions(t, fake.Options{Failures: []fake.Failure{{Verb: "list", Resource: "rollouts", Err: test.listErr}}}, append(fake.NewCluster(), canary, orphan)...)
+			promicher := newTestPromicher(t, kube)
+			promicher.StatusAnnotation = "promicher_status"
+
+			canaryLabels := map[string]string{"alertname": "PodCrashLooping", "namespace": fake.ClusterNamespace, "pod": "canary"}
+
+			alert := processAlert(t, promicher, map[string]interface{}{"labels": canaryLabels})
+			if status := alert.Annotations["promicher_status"]; status != test.expectedStatus {
+				t.Errorf("expected status '%s', got '%s'", test.expectedStatus, status)
+			}
+			if alert.Labels["team"] != "shop-team" {
+				t.Errorf("expected the alert enriched with the namespace, got %v", alert.Labels)
+			}
+
+			promicher.ErrorPolicy = FailBatch
+
+			// Not found objects do not fail the batch
+			orphanLabels := map[string]string{"alertname": "PodCrashLooping", "namespace": fake.ClusterNamespace, "pod": "orphan"}
+			if _, failed, err := promicher.ProcessAlerts([]Alert{{Labels: orphanLabels}}); err != nil || failed != 0 {
+				t.Errorf("expected the batch with a missing owner to succeed, got %d failed, error %v", failed, err)
+			}
+
+			if res, _, err := promicher.ProcessAlerts([]Alert{{Labels: orphanLabels}, {Labels: canaryLabels}}); err == nil || res != nil {
+				t.Errorf("expected the batch to fail, got %v, error %v", res, err)
+			}
+		})
+	}
+}
+
+func TestProcessAlertsIsolatesFailedAlerts(t *testing.T) {
+	promicher := newTestPromicher(t, newTestKube(t, fake.NewCluster()...))
+
+	rules, err := NewPatternsRules([]string{"app"}, nil, ErrorOnConflict, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	promicher.SetConfig(&Config{Rules: rules, Targets: DefaultTargets})
+	promicher.StatusAnnotation = "promicher_status"
+
+	conflicting := map[string]string{"alertname": "Conflicting", "namespace": fake.ClusterNamespace, "pod": fake.ClusterPod, "app": "api"}
+	enriched := map[string]string{"alertname": "Enriched", "namespace": fake.ClusterNamespace, "pod": fake.ClusterJobPod}
+	alerts := []Alert{{Labels: conflicting}, {Labels: enriched}}
+
+	t.Run("forward", func(t *testing.T) {
+		promicher.FailedAlertPolicy = ForwardFailedAlert
+
+		res, failed, err := promicher.ProcessAlerts(alerts)
+		if err != nil || failed != 1 {
+			t.Fatalf("expected 1 failed alert, got %d, error %v", failed, err)
+		}
+		if len(res) != 2 {
+			t.Fatalf("expected 2 alerts, got %d", len(res))
+		}
+		if !reflect.DeepEqual(res[0].Labels, conflicting) || res[0].Annotations["promicher_status"] != StatusFailed {
+			t.Errorf("expected the failed alert unchanged, got %v %v", res[0].Labels, res[0].Annotations)
+		}
+		if res[1].Labels["app"] != "backup" {
+			t.Errorf("expected the other alert enriched, got %v", res[1].Labels)
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		promicher.FailedAlertPolicy = DropFailedAlert
+
+		res, failed, err := promicher.ProcessAlerts(alerts)
+		if err != nil || failed != 1 {
+			t.Fatalf("expected 1 failed alert, got %d, error %v", failed, err)
+		}
+		if len(res) != 1 || res[0].Labels["alertname"] != "Enriched" {
+			t.Fatalf("expected only the enriched alert, got %v", res)
+		}
+
+		diff := DiffAlerts(alerts, res)
+		expectedDiff := "alert #0 Conflicting:\n  (dropped)\nalert #1 Enriched:\n  + labels.app=\"backup\"\n  + annotations.promicher_status=\"enriched\""
+		if diff != expectedDiff {
+			t.Errorf("expected diff:\n%s\ngot:\n%s", expectedDiff, diff)
+		}
+	})
+}
+
+func TestProcessAlertsDropsOnlyFailedAlerts(t *testing.T) {
+	forbidden := errors.NewForbidden(schema.GroupResource{Group: "argoproj.io", Resource: "rollouts"}, "", fmt.Errorf("denied"))
+	canary := fake.OwnedBy(fake.NewObject("Pod", fake.ClusterNamespace, "canary"), fake.NewObject("Rollout", fake.ClusterNamespace, "canary"))
+
+	kube := newTestKubeWithOptions(t, fake.Options{Failures: []fake.Failure{{Verb: "list", Resource: "rollouts", Err: forbidden}}}, append(fake.NewCluster(), canary)...)
+	promicher := newTestPromicher(t, kube)
+	promicher.FailedAlertPolicy = DropFailedAlert
+
+	// The rollout owner is forbidden to load, the alert is enriched with the pod and the namespace
+	res, failed, err := promicher.ProcessAlerts([]Alert{{Labels: map[string]string{
+		"alertname": "PodCrashLooping", "namespace": fake.ClusterNamespace, "pod": "canary",
+	}}})
+	if err != nil || failed != 0 {
+		t.Fatalf("expected no failed alerts, got %d, error %v", failed, err)
+	}
+	if len(res) != 1 || res[0].Labels["team"] != "shop-team" {
+		t.Fatalf("expected the partially enriched alert, got %v", res)
+	}
+}
+
+func TestAlertFingerprint(t *testing.T) {
+	first := &Alert{Labels: map[string]string{"alertname": "Test", "pod": "web"}}
+	same := &Alert{Labels: map[string]string{"pod": "web", "alertname": "Test"}}
+	other := &Alert{Labels: map[string]string{"alertname": "Testpod", "": "web"}}
+
+	if first.Fingerprint() != same.Fingerprint() {
+		t.Errorf("expected equal fingerprints of equal labels")
+	}
+	if first.Fingerprint() == other.Fingerprint() {
+		t.Errorf("expected different fingerprints of different labels")
+	}
+}
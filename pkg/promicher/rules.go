@@ -0,0 +1,319 @@
+package promicher
+
+import (
+	"fmt"
+	"github.com/flant/promicher/pkg/kube"
+	"github.com/romana/rlog"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"regexp"
+	"strings"
+)
+
+// DataKind is a kind of metadata: kubernetes object labels or annotations, alert labels or annotations.
+type DataKind string
+
+const (
+	LabelsData      DataKind = "labels"
+	AnnotationsData DataKind = "annotations"
+)
+
+// Rule selects metadata of kubernetes objects into the alert.
+type Rule struct {
+	// Name is used in logs only.
+	Name string `json:"name,omitempty"`
+	// Kinds of kubernetes objects the rule applies to, any kind when empty.
+	Kinds []string `json:"kinds,omitempty"`
+	// NamespaceSelector matches labels of the object namespace (or the Namespace object itself), any namespace when empty.
+	NamespaceSelector *meta_v1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// Alerts matches alert labels values by regular expressions, any alert when empty.
+	Alerts map[string]string `json:"alerts,omitempty"`
+	// From is the object metadata to select keys from: labels or annotations.
+	From DataKind `json:"from"`
+	// Keys are patterns of the object metadata keys, the format is the same as of --labels flag.
+	Keys []string `json:"keys"`
+	// Rename maps selected keys to the new keys.
+	Rename map[string]string `json:"rename,omitempty"`
+	// To is the alert metadata to write selected keys to: labels or annotations, the same as From when empty.
+	To DataKind `json:"to,omitempty"`
+	// Transform steps are applied in order to every selected value.
+	Transform []*Transform `json:"transform,omitempty"`
+	// Prefix is prepended to selected keys after rename to avoid collisions with alert keys.
+	Prefix string `json:"prefix,omitempty"`
+	// Merge is the merge policy of selected keys, DefaultMergePolicy when empty.
+	Merge MergePolicy `json:"merge,omitempty"`
+	// MergeKeys overrides the merge policy of the resulting keys.
+	MergeKeys map[string]MergePolicy `json:"mergeKeys,omitempty"`
+
+	keyPatterns       PatternSet
+	namespaceSelector labels.Selector
+	alertMatchers     map[string]*regexp.Regexp
+}
+
+// NewPatternsRules makes rules equivalent to --labels and --annotations patterns:
+// selected object labels go to alert labels and object annotations go to alert annotations.
+func NewPatternsRules(labelsPatterns, annotationsPatterns []string, merge MergePolicy, prefix string) ([]*Rule, error) {
+	var res []*Rule
+
+	if len(labelsPatterns) > 0 {
+		res = append(res, &Rule{Name: "--labels", From: LabelsData, Keys: labelsPatterns, Merge: merge, Prefix: prefix})
+	}
+	if len(annotationsPatterns) > 0 {
+		res = append(res, &Rule{Name: "--annotations", From: AnnotationsData, Keys: annotationsPatterns, Merge: merge, Prefix: prefix})
+	}
+
+	for _, rule := range res {
+		if err := rule.Compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// Compile validates the rule and prepares its selectors.
+func (rule *Rule) Compile() error {
+	if rule.From != LabelsData && rule.From != AnnotationsData {
+		return fmt.Errorf("rule '%s': bad from '%s': expected %s or %s", rule.Name, rule.From, LabelsData, AnnotationsData)
+	}
+
+	if rule.To == "" {
+		rule.To = rule.From
+	} else if rule.To != LabelsData && rule.To != AnnotationsData {
+		return fmt.Errorf("rule '%s': bad to '%s': expected %s or %s", rule.Name, rule.To, LabelsData, AnnotationsData)
+	}
+
+	if len(rule.Keys) == 0 {
+		return fmt.Errorf("rule '%s': keys are required", rule.Name)
+	}
+	keyPatterns, err := CompilePatterns(rule.Keys)
+	if err != nil {
+		return fmt.Errorf("rule '%s': %s", rule.Name, err)
+	}
+	rule.keyPatterns = keyPatterns
+
+	rule.namespaceSelector = labels.Everything()
+	if rule.NamespaceSelector != nil {
+		selector, err := meta_v1.LabelSelectorAsSelector(rule.NamespaceSelector)
+		if err != nil {
+			return fmt.Errorf("rule '%s': bad namespaceSelector: %s", rule.Name, err)
+		}
+		rule.namespaceSelector = selector
+	}
+
+	if rule.Merge == "" {
+		rule.Merge = DefaultMergePolicy
+	}
+	if _, err := ParseMergePolicy(string(rule.Merge)); err != nil {
+		return fmt.Errorf("rule '%s': %s", rule.Name, err)
+	}
+	for key, policy := range rule.MergeKeys {
+		if _, err := ParseMergePolicy(string(policy)); err != nil {
+			return fmt.Errorf("rule '%s': mergeKeys %s: %s", rule.Name, key, err)
+		}
+	}
+
+	for i, transform := range rule.Transform {
+		if err := transform.Compile(); err != nil {
+			return fmt.Errorf("rule '%s': transform #%d: %s", rule.Name, i, err)
+		}
+	}
+
+	rule.alertMatchers = make(map[string]*regexp.Regexp)
+	for label, pattern := range rule.Alerts {
+		rgxp, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", pattern))
+		if err != nil {
+			return fmt.Errorf("rule '%s': bad alerts matcher %s='%s': %s", rule.Name, label, pattern, err)
+		}
+		rule.alertMatchers[label] = rgxp
+	}
+
+	return nil
+}
+
+// Matches reports whether the rule applies to the object of the kind in the namespace with the labels for the alert.
+func (rule *Rule) Matches(kind string, namespaceLabels map[string]string, alert *Alert) bool {
+	if len(rule.Kinds) > 0 {
+		kindMatched := false
+		for _, ruleKind := range rule.Kinds {
+			if ruleKind == kind {
+				kindMatched = true
+				break
+			}
+		}
+		if !kindMatched {
+			return false
+		}
+	}
+
+	if !rule.namespaceSelector.Matches(labels.Set(namespaceLabels)) {
+		return false
+	}
+
+	for label, rgxp := range rule.alertMatchers {
+		if !rgxp.MatchString(alert.Labels[label]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Select returns object metadata selected by the rule keys with renames, prefix and transforms applied
+// and sources of the selected keys. Keys failed to transform are skipped.
+func (rule *Rule) Select(obj *unstructured.Unstructured, alert *Alert) (map[string]string, map[string]SelectedKey, error) {
+	data := obj.GetLabels()
+	if rule.From == AnnotationsData {
+		data = obj.GetAnnotations()
+	}
+
+	selected, sources := rule.keyPatterns.Select(data)
+
+	res := make(map[string]string)
+	resSources := make(map[string]SelectedKey)
+	for k, v := range selected {
+		source := sources[k]
+		if newKey, hasKey := rule.Rename[k]; hasKey {
+			k = newKey
+		}
+		k = rule.Prefix + k
+
+		v, err := rule.transform(k, v, obj, alert)
+		if err != nil {
+			rlog.Errorf("rule '%s': cannot transform %s key '%s' of %s/%s: %s", rule.Name, rule.From, source.SourceKey, obj.GetKind(), obj.GetName(), err)
+			continue
+		}
+
+		res[k] = v
+		resSources[k] = source
+	}
+
+	return res, resSources, nil
+}
+
+// MergePolicy returns the merge policy of the resulting key.
+func (rule *Rule) MergePolicy(key string) MergePolicy {
+	if policy, hasKey := rule.MergeKeys[key]; hasKey {
+		return policy
+	}
+	if rule.Merge == "" {
+		return DefaultMergePolicy
+	}
+	return rule.Merge
+}
+
+func (rule *Rule) transform(key, value string, obj *unstructured.Unstructured, alert *Alert) (string, error) {
+	context := &TransformContext{Key: key, Value: value, Alert: alert, Object: obj.Object}
+
+	for i, transform := range rule.Transform {
+		var err error
+		context.Value, err = transform.Apply(context)
+		if err != nil {
+			return "", fmt.Errorf("transform #%d: %s", i, err)
+		}
+	}
+
+	return context.Value, nil
+}
+
+// DefaultMaxOwnerDepth limits owner references followed from the alert target object.
+const DefaultMaxOwnerDepth = 10
+
+// DataSelector applies rules to kubernetes objects related to a single alert
+// and keeps the state of the walk through the objects.
+type DataSelector struct {
+	Alert *Alert
+	Rules []*Rule
+	// MaxOwnerDepth limits owner references followed from the target object, 0 means owners are not loaded
+	MaxOwnerDepth int
+	// Explanation records objects and selections when set
+	Explanation *AlertExplanation
+	// LoadErrors are errors of loading the target object, its owners and its namespace
+	LoadErrors []*LoadError
+
+	namespacesLabels map[string]map[string]string
+	namespacesLoaded map[string]bool
+	visited          map[string]bool
+	ownerChain       []string
+}
+
+func NewDataSelector(alert *Alert, rules []*Rule) *DataSelector {
+	return &DataSelector{
+		Alert:            alert,
+		Rules:            rules,
+		MaxOwnerDepth:    DefaultMaxOwnerDepth,
+		namespacesLabels: make(map[string]map[string]string),
+		namespacesLoaded: make(map[string]bool),
+		visited:          make(map[string]bool),
+	}
+}
+
+// Visit marks the object walked, it returns false when the object is already walked.
+func (selector *DataSelector) Visit(resource *KubeResourceInfo) bool {
+	if selector.visited[resource.CacheId()] {
+		return false
+	}
+	selector.visited[resource.CacheId()] = true
+	return true
+}
+
+// VisitNamespace marks the namespace loaded, it returns false when the namespace is already loaded.
+func (selector *DataSelector) VisitNamespace(namespace string) bool {
+	if selector.namespacesLoaded[namespace] {
+		return false
+	}
+	selector.namespacesLoaded[namespace] = true
+	return true
+}
+
+// AddToOwnerChain records the object at the depth when it continues the chain of first owners from the target.
+func (selector *DataSelector) AddToOwnerChain(depth int, kind, name string) {
+	if len(selector.ownerChain) == depth-TargetDepth {
+		selector.ownerChain = append(selector.ownerChain, fmt.Sprintf("%s/%s", kind, name))
+	}
+}
+
+// FailedLoadErrors returns load errors except not found objects: errors of objects which may exist.
+func (selector *DataSelector) FailedLoadErrors() []*LoadError {
+	var res []*LoadError
+	for _, loadErr := range selector.LoadErrors {
+		if loadErr.Reason != NotFound {
+			res = append(res, loadErr)
+		}
+	}
+	return res
+}
+
+// OwnerChain returns the chain of first owners from the farthest owner to the target, e.g. "Deployment/api > ReplicaSet/api-7d > Pod/api-7d-x".
+func (selector *DataSelector) OwnerChain() string {
+	res := make([]string, 0, len(selector.ownerChain))
+	for i := len(selector.ownerChain) - 1; i >= 0; i-- {
+		res = append(res, selector.ownerChain[i])
+	}
+	return strings.Join(res, " > ")
+}
+
+// NamespaceLabels returns labels of the namespace for rules namespace selectors,
+// labels are empty for cluster-scoped objects and unknown namespaces.
+func (selector *DataSelector) NamespaceLabels(kube *kube.Kube, namespace string) map[string]string {
+	if namespace == "" {
+		return nil
+	}
+
+	if namespaceLabels, hasKey := selector.namespacesLabels[namespace]; hasKey {
+		return namespaceLabels
+	}
+
+	var namespaceLabels map[string]string
+	resource, err := kube.GetObject("v1", "Namespace", "", namespace)
+	if err != nil {
+		rlog.Errorf("error fetching kube ns/%s labels for rules: %s", namespace, err)
+	} else {
+		namespaceLabels = resource.GetLabels()
+	}
+
+	selector.namespacesLabels[namespace] = namespaceLabels
+
+	return namespaceLabels
+}
@@ -0,0 +1,125 @@
+package promicher
+
+import (
+	"fmt"
+	"github.com/flant/promicher/pkg/kube"
+	"github.com/romana/rlog"
+	"sort"
+)
+
+// Target maps alert labels to the kubernetes object the alert is about.
+type Target struct {
+	// Kind of the kubernetes object.
+	Kind string `json:"kind"`
+	// Alert labels containing the object name, the first present label is used.
+	Labels []string `json:"labels"`
+	// Alert labels containing the object namespace, the first present label is used.
+	// The target does not match when none of them is present.
+	// Empty for cluster-scoped kinds.
+	NamespaceLabels []string `json:"namespaceLabels,omitempty"`
+	// Targets with higher priority are tried first, targets with equal priority are tried in order.
+	Priority int `json:"priority,omitempty"`
+	// By is how the object is found by the label value: by name, which is the default,
+	// or by address for Node objects, the label value is an IP or hostname with an optional port.
+	By TargetBy `json:"by,omitempty"`
+}
+
+type TargetBy string
+
+const (
+	ByName    TargetBy = "name"
+	ByAddress TargetBy = "address"
+)
+
+// DefaultTargets are used when the rules file has no targets.
+var DefaultTargets = []*Target{
+	{Kind: "Pod", Labels: []string{"pod"}, NamespaceLabels: []string{"namespace"}},
+	{Kind: "Deployment", Labels: []string{"deployment"}, NamespaceLabels: []string{"namespace"}},
+	{Kind: "StatefulSet", Labels: []string{"statefulset"}, NamespaceLabels: []string{"namespace"}},
+	{Kind: "DaemonSet", Labels: []string{"daemonset"}, NamespaceLabels: []string{"namespace"}},
+	// Prometheus adds the scrape job label "job" to every alert, kube-state-metrics has the job name in "job_name"
+	{Kind: "Job", Labels: []string{"job_name"}, NamespaceLabels: []string{"namespace"}},
+	{Kind: "CronJob", Labels: []string{"cronjob"}, NamespaceLabels: []string{"namespace"}},
+	{Kind: "PersistentVolumeClaim", Labels: []string{"persistentvolumeclaim"}, NamespaceLabels: []string{"namespace"}},
+	// Cluster-scoped kinds go before the namespace fallback:
+	// alerts about nodes and volumes often get the namespace label of the exporter.
+	{Kind: "PersistentVolume", Labels: []string{"persistentvolume"}},
+	{Kind: "StorageClass", Labels: []string{"storageclass"}},
+	{Kind: "Node", Labels: []string{"node"}},
+	// Node exporter alerts usually have only the instance label with the node address and the exporter port
+	{Kind: "Node", Labels: []string{"instance"}, By: ByAddress},
+	{Kind: "Namespace", Labels: []string{"namespace"}},
+}
+
+// SortTargets validates targets and orders them by priority.
+func SortTargets(targets []*Target) ([]*Target, error) {
+	for i, target := range targets {
+		if target.Kind == "" {
+			return nil, fmt.Errorf("target #%d: kind is required", i)
+		}
+		if len(target.Labels) == 0 {
+			return nil, fmt.Errorf("target #%d %s: labels are required", i, target.Kind)
+		}
+		switch target.By {
+		case "", ByName:
+		case ByAddress:
+			if target.Kind != "Node" {
+				return nil, fmt.Errorf("target #%d %s: only Node may be found by %s", i, target.Kind, ByAddress)
+			}
+		default:
+			return nil, fmt.Errorf("target #%d %s: bad by '%s': expected %s or %s", i, target.Kind, target.By, ByName, ByAddress)
+		}
+	}
+
+	res := make([]*Target, len(targets))
+	copy(res, targets)
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Priority > res[j].Priority
+	})
+
+	return res, nil
+}
+
+// Resolve returns the target object of the alert or nil when the alert has no target labels.
+func (target *Target) Resolve(kube *kube.Kube, alert *Alert) *KubeResourceInfo {
+	name := firstLabelValue(alert, target.Labels)
+	if name == "" {
+		return nil
+	}
+
+	if target.By == ByAddress {
+		nodeName, err := kube.FindNodeByAddress(name)
+		if err != nil {
+			rlog.Errorf("error finding kube node by address '%s': %s", name, err)
+			return nil
+		}
+		if nodeName == "" {
+			rlog.Debugf("No kube node with address '%s'", name)
+			return nil
+		}
+		name = nodeName
+	}
+
+	namespace := ""
+	if len(target.NamespaceLabels) > 0 {
+		namespace = firstLabelValue(alert, target.NamespaceLabels)
+		if namespace == "" {
+			return nil
+		}
+	}
+
+	return &KubeResourceInfo{
+		Namespace: namespace,
+		Kind:      target.Kind,
+		Name:      name,
+	}
+}
+
+func firstLabelValue(alert *Alert, labels []string) string {
+	for _, label := range labels {
+		if value := alert.Labels[label]; value != "" {
+			return value
+		}
+	}
+	return ""
+}
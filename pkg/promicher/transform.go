@@ -0,0 +1,159 @@
+package promicher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"k8s.io/client-go/util/jsonpath"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Transform is a step of the rule values transformation, exactly one of the fields should be set.
+type Transform struct {
+	// Replace replaces matches of the regular expression, $1 and ${name} are expanded in the replacement.
+	Replace *ReplaceTransform `json:"replace,omitempty"`
+	// Lowercase makes the value lowercase.
+	Lowercase bool `json:"lowercase,omitempty"`
+	// Truncate cuts the value to the number of characters.
+	Truncate int `json:"truncate,omitempty"`
+	// Default replaces the empty value.
+	Default string `json:"default,omitempty"`
+	// JSONPath extracts data from the JSON value with the kubectl JSONPath template, e.g. "{.channel}".
+	JSONPath string `json:"jsonPath,omitempty"`
+	// Template renders the value with the Go template of TransformContext, e.g. "#{{ .Value }}-alerts".
+	Template string `json:"template,omitempty"`
+
+	replaceRegexp *regexp.Regexp
+	// JSONPath keeps the parsing state, so it is not safe to use it concurrently
+	jsonPathMutex sync.Mutex
+	jsonPath      *jsonpath.JSONPath
+	template      *template.Template
+}
+
+type ReplaceTransform struct {
+	Regexp string `json:"regexp"`
+	With   string `json:"with"`
+}
+
+// TransformContext is the data of the Template transform.
+type TransformContext struct {
+	// Key is the selected key after rename.
+	Key string
+	// Value is the value transformed by previous steps.
+	Value string
+	// Alert is the alert being enriched.
+	Alert *Alert
+	// Object is the kubernetes object the value is selected from, e.g. {{ .Object.metadata.name }}.
+	// Only nodes are full objects, objects of other kinds have apiVersion, kind and metadata only.
+	Object map[string]interface{}
+}
+
+var transformTemplateFuncs = template.FuncMap{
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"trimPrefix": strings.TrimPrefix,
+	"trimSuffix": strings.TrimSuffix,
+}
+
+// Compile validates the step and prepares its regular expression, JSONPath or template.
+func (transform *Transform) Compile() error {
+	steps := 0
+
+	if transform.Replace != nil {
+		steps++
+		rgxp, err := regexp.Compile(transform.Replace.Regexp)
+		if err != nil {
+			return fmt.Errorf("bad replace regexp '%s': %s", transform.Replace.Regexp, err)
+		}
+		transform.replaceRegexp = rgxp
+	}
+
+	if transform.Lowercase {
+		steps++
+	}
+
+	if transform.Truncate < 0 {
+		return fmt.Errorf("bad truncate %d: expected positive number", transform.Truncate)
+	} else if transform.Truncate > 0 {
+		steps++
+	}
+
+	if transform.Default != "" {
+		steps++
+	}
+
+	if transform.JSONPath != "" {
+		steps++
+		transform.jsonPath = jsonpath.New("jsonPath").AllowMissingKeys(true)
+		if err := transform.jsonPath.Parse(transform.JSONPath); err != nil {
+			return fmt.Errorf("bad jsonPath '%s': %s", transform.JSONPath, err)
+		}
+	}
+
+	if transform.Template != "" {
+		steps++
+		tmpl, err := template.New("template").Funcs(transformTemplateFuncs).Option("missingkey=zero").Parse(transform.Template)
+		if err != nil {
+			return fmt.Errorf("bad template '%s': %s", transform.Template, err)
+		}
+		transform.template = tmpl
+	}
+
+	if steps != 1 {
+		return fmt.Errorf("exactly one of replace, lowercase, truncate, default, jsonPath, template is expected, got %d", steps)
+	}
+
+	return nil
+}
+
+// Apply transforms context.Value.
+func (transform *Transform) Apply(context *TransformContext) (string, error) {
+	value := context.Value
+
+	switch {
+	case transform.replaceRegexp != nil:
+		return transform.replaceRegexp.ReplaceAllString(value, transform.Replace.With), nil
+
+	case transform.Lowercase:
+		return strings.ToLower(value), nil
+
+	case transform.Truncate > 0:
+		if runes := []rune(value); len(runes) > transform.Truncate {
+			return string(runes[:transform.Truncate]), nil
+		}
+		return value, nil
+
+	case transform.Default != "":
+		if value == "" {
+			return transform.Default, nil
+		}
+		return value, nil
+
+	case transform.jsonPath != nil:
+		var data interface{}
+		if err := json.Unmarshal([]byte(value), &data); err != nil {
+			return "", fmt.Errorf("jsonPath '%s': value is not JSON: %s", transform.JSONPath, err)
+		}
+
+		transform.jsonPathMutex.Lock()
+		defer transform.jsonPathMutex.Unlock()
+
+		var buf bytes.Buffer
+		if err := transform.jsonPath.Execute(&buf, data); err != nil {
+			return "", fmt.Errorf("jsonPath '%s': %s", transform.JSONPath, err)
+		}
+		return buf.String(), nil
+
+	case transform.template != nil:
+		var buf bytes.Buffer
+		if err := transform.template.Execute(&buf, context); err != nil {
+			return "", fmt.Errorf("template '%s': %s", transform.Template, err)
+		}
+		return buf.String(), nil
+	}
+
+	return value, nil
+}
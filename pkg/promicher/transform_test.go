@@ -0,0 +1,77 @@
+package promicher
+
+import (
+	"github.com/flant/promicher/pkg/kube/fake"
+	"testing"
+)
+
+func TestRuleSelectTransform(t *testing.T) {
+	obj := fake.WithMetadata(fake.NewObject("Deployment", "shop", "web"), nil, map[string]string{
+		"example.com/team":     "Payments",
+		"example.com/contacts": `{"slack": {"channel": "#payments-oncall"}, "email": "payments@example.com"}`,
+		"example.com/bad-json": "not json",
+		"example.com/empty":    "",
+	})
+	alert := &Alert{Labels: map[string]string{"alertname": "DeploymentUnavailable", "severity": "critical"}}
+
+	tests := []struct {
+		name      string
+		key       string
+		transform []*Transform
+		expected  string
+		skipped   bool
+	}{
+		{"replace", "team", []*Transform{{Replace: &ReplaceTransform{Regexp: "^(.)(.*)$", With: "${2}${1}"}}}, "aymentsP", false},
+		{"lowercase and truncate", "team", []*Transform{{Lowercase: true}, {Truncate: 3}}, "pay", false},
+		{"default of empty value", "empty", []*Transform{{Default: "none"}}, "none", false},
+		{"default of present value", "team", []*Transform{{Default: "none"}}, "Payments", false},
+		{"json path", "contacts", []*Transform{{JSONPath: "{.slack.channel}"}}, "#payments-oncall", false},
+		{"json path of missing key with default", "contacts", []*Transform{{JSONPath: "{.phone}"}, {Default: "none"}}, "none", false},
+		{"json path of not json value is skipped", "bad-json", []*Transform{{JSONPath: "{.slack}"}}, "", true},
+		{
+			"template with the alert and the object", "team",
+			[]*Transform{{Template: `#{{ lower .Value }}-{{ .Alert.Labels.severity }}-{{ .Object.metadata.name }}-{{ .Key }}`}},
+			"#payments-critical-web-team", false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := &Rule{Name: test.name, From: AnnotationsData, Keys: []string{"example.com/(?P<key>.*)"}, Transform: test.transform}
+			if err := rule.Compile(); err != nil {
+				t.Fatal(err)
+			}
+
+			data, _, err := rule.Select(obj, alert)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			value, hasKey := data[test.key]
+			if test.skipped {
+				if hasKey {
+					t.Errorf("expected key '%s' to be skipped, got '%s'", test.key, value)
+				}
+				return
+			}
+			if !hasKey || value != test.expected {
+				t.Errorf("expected '%s', got '%s' (present: %v)", test.expected, value, hasKey)
+			}
+		})
+	}
+}
+
+func TestTransformCompileErrors(t *testing.T) {
+	for _, transform := range []*Transform{
+		{},
+		{Lowercase: true, Truncate: 10},
+		{Truncate: -1},
+		{Replace: &ReplaceTransform{Regexp: "(unclosed"}},
+		{JSONPath: "{.unclosed"},
+		{Template: "{{ .Value"},
+	} {
+		if err := transform.Compile(); err == nil {
+			t.Errorf("expected error for transform %+v", transform)
+		}
+	}
+}
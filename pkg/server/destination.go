@@ -0,0 +1,156 @@
+package server
+
+import (
+	"fmt"
+	"github.com/flant/promicher/pkg/kube"
+	"github.com/flant/promicher/pkg/promicher"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Destination is an Alertmanager alerts API endpoint to proxy enriched alerts to.
+// The URL is empty for a service destination which has no ready endpoints yet.
+type Destination struct {
+	URL        string
+	APIVersion promicher.APIVersion
+	// Service is the service destination the endpoint belongs to, nil for static destinations.
+	Service *ServiceDestination
+}
+
+// ParseDestination parses destination in the format [v1=|v2=]URL.
+// API version is detected from the URL path when not specified explicitly.
+func ParseDestination(spec string) (*Destination, error) {
+	version, rawURL, err := splitAPIVersionPrefix(spec)
+	if err != nil {
+		return nil, fmt.Errorf("bad destination '%s': %s", spec, err)
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad destination '%s' url: %s", spec, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("bad destination '%s' url: scheme and host are required", spec)
+	}
+
+	if version == "" {
+		if strings.HasPrefix(u.Path, promicher.APIv2.AlertsPath()) {
+			version = promicher.APIv2
+		} else {
+			version = promicher.APIv1
+		}
+	}
+
+	return &Destination{URL: rawURL, APIVersion: version}, nil
+}
+
+func (destination *Destination) String() string {
+	if destination.URL == "" && destination.Service != nil {
+		return fmt.Sprintf("%s (API %s)", destination.Service, destination.APIVersion)
+	}
+	return fmt.Sprintf("%s (API %s)", destination.URL, destination.APIVersion)
+}
+
+// Name is the configured destination: the URL of a static destination or the service of a service endpoint.
+// Metrics are labeled by the name, so endpoints changed by rollouts do not make new series.
+func (destination *Destination) Name() string {
+	if destination.Service != nil {
+		return destination.Service.String()
+	}
+	return destination.URL
+}
+
+// ServiceDestination is a kubernetes Service, every ready endpoint of which is a Destination.
+type ServiceDestination struct {
+	Namespace  string
+	Name       string
+	Port       string
+	APIVersion promicher.APIVersion
+}
+
+// ParseServiceDestination parses service destination in the format [v1=|v2=]namespace/name[:port].
+// Port is a name or a number of the endpoints port, it may be omitted when endpoints have a single port.
+// API version is v1 when not specified explicitly.
+func ParseServiceDestination(spec string) (*ServiceDestination, error) {
+	version, service, err := splitAPIVersionPrefix(spec)
+	if err != nil {
+		return nil, fmt.Errorf("bad destination service '%s': %s", spec, err)
+	}
+	if version == "" {
+		version = promicher.APIv1
+	}
+
+	destination := &ServiceDestination{APIVersion: version}
+
+	if parts := strings.SplitN(service, ":", 2); len(parts) == 2 {
+		service = parts[0]
+		destination.Port = parts[1]
+	}
+
+	parts := strings.Split(service, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("bad destination service '%s': expected namespace/name[:port]", spec)
+	}
+	destination.Namespace = parts[0]
+	destination.Name = parts[1]
+
+	return destination, nil
+}
+
+func (destination *ServiceDestination) String() string {
+	res := fmt.Sprintf("ns/%s service/%s", destination.Namespace, destination.Name)
+	if destination.Port != "" {
+		res = fmt.Sprintf("%s:%s", res, destination.Port)
+	}
+	return res
+}
+
+// Resolve returns destinations for all ready addresses of the service endpoints.
+func (destination *ServiceDestination) Resolve(kube *kube.Kube) ([]*Destination, error) {
+	endpoints, err := kube.Informers.Core().V1().Endpoints().Lister().Endpoints(destination.Namespace).Get(destination.Name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get endpoints of %s: %s", destination, err)
+	}
+
+	res := make([]*Destination, 0)
+
+	for _, subset := range endpoints.Subsets {
+		port := ""
+		for _, endpointPort := range subset.Ports {
+			portNumber := strconv.Itoa(int(endpointPort.Port))
+			if destination.Port == "" && len(subset.Ports) == 1 ||
+				destination.Port == endpointPort.Name ||
+				destination.Port == portNumber {
+				port = portNumber
+				break
+			}
+		}
+		if port == "" {
+			continue
+		}
+
+		for _, address := range subset.Addresses {
+			res = append(res, &Destination{
+				URL:        fmt.Sprintf("http://%s%s", net.JoinHostPort(address.IP, port), destination.APIVersion.AlertsPath()),
+				APIVersion: destination.APIVersion,
+				Service:    destination,
+			})
+		}
+	}
+
+	return res, nil
+}
+
+func splitAPIVersionPrefix(spec string) (promicher.APIVersion, string, error) {
+	if parts := strings.SplitN(spec, "=", 2); len(parts) == 2 && !strings.Contains(parts[0], "/") {
+		version, err := promicher.ParseAPIVersion(parts[0])
+		if err != nil {
+			return "", "", err
+		}
+		return version, parts[1], nil
+	}
+
+	return "", spec, nil
+}
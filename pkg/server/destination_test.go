@@ -0,0 +1,75 @@
+package server
+
+import (
+	"github.com/flant/promicher/pkg/kube"
+	"github.com/flant/promicher/pkg/kube/fake"
+	"github.com/flant/promicher/pkg/promicher"
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+// newTestServiceKube makes the fake cluster with the monitoring/alertmanager service endpoint at the address.
+func newTestServiceKube(t *testing.T, ip string, port int32) *kube.Kube {
+	t.Helper()
+
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+
+	res, err := fake.NewKube(stopCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addTestServiceEndpoint(t, res, ip, port)
+
+	return res
+}
+
+// addTestServiceEndpoint sets the only ready endpoint of the monitoring/alertmanager service.
+func addTestServiceEndpoint(t *testing.T, kube *kube.Kube, ip string, port int32) {
+	t.Helper()
+
+	err := kube.Informers.Core().V1().Endpoints().Informer().GetIndexer().Add(&core_v1.Endpoints{
+		ObjectMeta: meta_v1.ObjectMeta{Namespace: "monitoring", Name: "alertmanager"},
+		Subsets: []core_v1.EndpointSubset{{
+			Addresses: []core_v1.EndpointAddress{{IP: ip}},
+			Ports:     []core_v1.EndpointPort{{Name: "web", Port: port}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServiceDestinationResolve(t *testing.T) {
+	service, err := ParseServiceDestination("v2=monitoring/alertmanager:web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	destinations, err := service.Resolve(newTestServiceKube(t, "10.0.2.7", 9093))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(destinations) != 1 {
+		t.Fatalf("expected 1 destination, got %v", destinations)
+	}
+
+	destination := destinations[0]
+	if destination.URL != "http://10.0.2.7:9093"+promicher.APIv2.AlertsPath() {
+		t.Errorf("unexpected destination url %s", destination.URL)
+	}
+	// Metrics are labeled by the service, not by the endpoint address
+	if name := destination.Name(); name != "ns/monitoring service/alertmanager:web" {
+		t.Errorf("unexpected destination name %s", name)
+	}
+
+	static, err := ParseDestination("http://alertmanager:9093/api/v1/alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := static.Name(); name != static.URL {
+		t.Errorf("expected static destination name %s, got %s", static.URL, name)
+	}
+}
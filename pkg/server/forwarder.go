@@ -0,0 +1,275 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/flant/promicher/pkg/kube"
+	"github.com/flant/promicher/pkg/metrics"
+	"github.com/flant/promicher/pkg/promicher"
+	"github.com/romana/rlog"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SuccessPolicy decides whether forwarding to a set of destinations succeeded.
+type SuccessPolicy string
+
+const (
+	PolicyAny    SuccessPolicy = "any"
+	PolicyAll    SuccessPolicy = "all"
+	PolicyQuorum SuccessPolicy = "quorum"
+)
+
+func ParseSuccessPolicy(policy string) (SuccessPolicy, error) {
+	switch SuccessPolicy(policy) {
+	case PolicyAny, PolicyAll, PolicyQuorum:
+		return SuccessPolicy(policy), nil
+	}
+
+	return "", fmt.Errorf("unsupported success policy '%s': expected %s, %s or %s", policy, PolicyAny, PolicyAll, PolicyQuorum)
+}
+
+func (policy SuccessPolicy) IsSatisfied(succeeded, total int) bool {
+	if total == 0 {
+		return false
+	}
+
+	switch policy {
+	case PolicyAll:
+		return succeeded == total
+	case PolicyQuorum:
+		return succeeded > total/2
+	default:
+		return succeeded > 0
+	}
+}
+
+// ForwardResult is a result of sending alerts to a single destination.
+type ForwardResult struct {
+	Destination *Destination
+	RequestData []byte
+	StatusCode  int
+	Status      string
+	Header      http.Header
+	Body        []byte
+	Err         error
+}
+
+func (result *ForwardResult) IsSuccess() bool {
+	return result.Err == nil && result.StatusCode >= 200 && result.StatusCode < 300
+}
+
+// IsRetryable reports whether sending the same request later may succeed.
+func (result *ForwardResult) IsRetryable() bool {
+	if result.RequestData == nil {
+		return false
+	}
+	if result.Err != nil {
+		return true
+	}
+	return result.StatusCode >= 500 || result.StatusCode == http.StatusTooManyRequests
+}
+
+func (result *ForwardResult) String() string {
+	if result.Err != nil {
+		return fmt.Sprintf("%s: %s", result.Destination, result.Err)
+	}
+	return fmt.Sprintf("%s: %s", result.Destination, result.Status)
+}
+
+// Forwarder sends enriched alerts to all destinations concurrently.
+type Forwarder struct {
+	Destinations        []*Destination
+	ServiceDestinations []*ServiceDestination
+	Policy              SuccessPolicy
+	Kube                *kube.Kube
+	Client              *http.Client
+}
+
+func NewForwarder(destinations []*Destination, serviceDestinations []*ServiceDestination, policy SuccessPolicy, timeout time.Duration, kube *kube.Kube) *Forwarder {
+	return &Forwarder{
+		Destinations:        destinations,
+		ServiceDestinations: serviceDestinations,
+		Policy:              policy,
+		Kube:                kube,
+		Client:              &http.Client{Timeout: timeout},
+	}
+}
+
+// ResolveDestinations returns static destinations and current endpoints of service destinations.
+func (forwarder *Forwarder) ResolveDestinations() []*Destination {
+	destinations, _ := forwarder.resolveDestinations()
+	return destinations
+}
+
+// resolveDestinations returns static destinations, current endpoints of service destinations
+// and service destinations without ready endpoints with the reasons.
+func (forwarder *Forwarder) resolveDestinations() ([]*Destination, []*unresolvedDestination) {
+	res := make([]*Destination, 0, len(forwarder.Destinations))
+	res = append(res, forwarder.Destinations...)
+
+	var unresolved []*unresolvedDestination
+	for _, serviceDestination := range forwarder.ServiceDestinations {
+		destinations, err := serviceDestination.Resolve(forwarder.Kube)
+		if err != nil {
+			rlog.Errorf("Cannot resolve destination %s: %s", serviceDestination, err)
+			unresolved = append(unresolved, &unresolvedDestination{Service: serviceDestination, Err: err})
+			continue
+		}
+		if len(destinations) == 0 {
+			rlog.Warnf("Destination %s has no ready endpoints", serviceDestination)
+			unresolved = append(unresolved, &unresolvedDestination{
+				Service: serviceDestination,
+				Err:     fmt.Errorf("destination %s has no ready endpoints", serviceDestination),
+			})
+		}
+		res = append(res, destinations...)
+	}
+
+	return res, unresolved
+}
+
+// unresolvedDestination is a service destination without ready endpoints, e.g. while Alertmanager pods restart.
+type unresolvedDestination struct {
+	Service *ServiceDestination
+	Err     error
+}
+
+// Forward sends alerts to every resolved destination in its API version and waits for all results.
+// A service destination without ready endpoints gets a failed result with the request data,
+// so the request is retried to endpoints of the service resolved later.
+func (forwarder *Forwarder) Forward(method string, header http.Header, alerts []promicher.Alert) []*ForwardResult {
+	destinations, unresolved := forwarder.resolveDestinations()
+	results := make([]*ForwardResult, len(destinations), len(destinations)+len(unresolved))
+
+	var wg sync.WaitGroup
+	for i, destination := range destinations {
+		wg.Add(1)
+		go func(i int, destination *Destination) {
+			defer wg.Done()
+			results[i] = forwarder.Send(destination, method, header, alerts)
+		}(i, destination)
+	}
+	wg.Wait()
+
+	for _, unresolvedDestination := range unresolved {
+		results = append(results, forwarder.unresolvedResult(unresolvedDestination, alerts))
+	}
+
+	return results
+}
+
+func (forwarder *Forwarder) unresolvedResult(unresolved *unresolvedDestination, alerts []promicher.Alert) *ForwardResult {
+	destination := &Destination{APIVersion: unresolved.Service.APIVersion, Service: unresolved.Service}
+	metrics.ForwardRequests.WithLabelValues(destination.Name(), "failure").Inc()
+
+	dataBytes, err := promicher.DumpAlerts(alerts, destination.APIVersion)
+	if err != nil {
+		return &ForwardResult{
+			Destination: destination,
+			Err:         fmt.Errorf("cannot dump API %s alerts: %s", destination.APIVersion, err),
+		}
+	}
+
+	return &ForwardResult{Destination: destination, RequestData: dataBytes, Err: unresolved.Err}
+}
+
+func (forwarder *Forwarder) Send(destination *Destination, method string, header http.Header, alerts []promicher.Alert) *ForwardResult {
+	dataBytes, err := promicher.DumpAlerts(alerts, destination.APIVersion)
+	if err != nil {
+		return &ForwardResult{
+			Destination: destination,
+			Err:         fmt.Errorf("cannot dump API %s alerts: %s", destination.APIVersion, err),
+		}
+	}
+
+	return forwarder.SendData(destination, method, header, dataBytes)
+}
+
+// SendData sends alerts data already dumped in the destination API version.
+func (forwarder *Forwarder) SendData(destination *Destination, method string, header http.Header, dataBytes []byte) *ForwardResult {
+	result := &ForwardResult{Destination: destination, RequestData: dataBytes}
+
+	request, err := http.NewRequest(method, destination.URL, bytes.NewReader(dataBytes))
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	for k, v := range header {
+		request.Header[k] = v
+	}
+
+	rlog.Debugf("Proxying to %s", destination)
+
+	start := time.Now()
+	defer func() {
+		metrics.ForwardDuration.WithLabelValues(destination.Name()).Observe(time.Since(start).Seconds())
+
+		outcome := "success"
+		if !result.IsSuccess() {
+			outcome = "failure"
+		}
+		metrics.ForwardRequests.WithLabelValues(destination.Name(), outcome).Inc()
+	}()
+
+	response, err := forwarder.Client.Do(request)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer response.Body.Close()
+
+	result.StatusCode = response.StatusCode
+	result.Status = response.Status
+	result.Header = response.Header
+
+	result.Body, err = ioutil.ReadAll(response.Body)
+	if err != nil {
+		result.Err = fmt.Errorf("error reading response: %s", err)
+		return result
+	}
+
+	rlog.Debugf("Received response from %s: %s\n%s", destination, response.Status, string(result.Body))
+
+	return result
+}
+
+// CheckDestination requests Alertmanager readiness endpoint /-/ready next to the destination alerts API path.
+func (forwarder *Forwarder) CheckDestination(destination *Destination) error {
+	u, err := url.Parse(destination.URL)
+	if err != nil {
+		return err
+	}
+
+	if idx := strings.Index(u.Path, "/api/"); idx >= 0 {
+		u.Path = u.Path[:idx]
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/-/ready"
+	u.RawQuery = ""
+
+	client := &http.Client{Timeout: HealthCheckTimeout}
+	response, err := client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", u.String(), response.Status)
+	}
+
+	return nil
+}
+
+// Summary describes forward results to be returned to Prometheus.
+func (forwarder *Forwarder) Summary(results []*ForwardResult) string {
+	lines := make([]string, 0, len(results))
+	for _, result := range results {
+		lines = append(lines, result.String())
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/romana/rlog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheckTimeout limits every readiness check, so a hanging dependency does not hang the probe.
+const HealthCheckTimeout = 3 * time.Second
+
+type HealthCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+type HealthReport struct {
+	Status string         `json:"status"`
+	Checks []*HealthCheck `json:"checks"`
+}
+
+// HandleLive reports the process is alive: it serves http requests.
+func (server *Server) HandleLive(w http.ResponseWriter, _ *http.Request) {
+	writeHealthReport(w, &HealthReport{Checks: []*HealthCheck{{Name: "http", OK: true}}})
+}
+
+// HandleReady reports whether promicher is able to enrich and forward alerts.
+func (server *Server) HandleReady(w http.ResponseWriter, _ *http.Request) {
+	writeHealthReport(w, &HealthReport{Checks: server.ReadinessChecks()})
+}
+
+// ReadinessChecks checks the shutdown state, API server reachability,
+// informers caches and reachability of destinations according to the destination policy.
+func (server *Server) ReadinessChecks() []*HealthCheck {
+	shutdownCheck := &HealthCheck{Name: "shutdown", OK: true}
+	if atomic.LoadInt32(&server.shuttingDown) == 1 {
+		shutdownCheck.OK = false
+		shutdownCheck.Message = "shutting down"
+	}
+
+	checks := []*HealthCheck{shutdownCheck, server.informersCheck()}
+
+	var wg sync.WaitGroup
+	var apiServerCheck, destinationsCheck *HealthCheck
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		apiServerCheck = runHealthCheck("kube-apiserver", func() error {
+			_, err := server.Promicher.Kube.Client.Discovery().ServerVersion()
+			return err
+		})
+	}()
+	go func() {
+		defer wg.Done()
+		destinationsCheck = runHealthCheck("destinations", server.checkDestinations)
+	}()
+	wg.Wait()
+
+	return append(checks, apiServerCheck, destinationsCheck)
+}
+
+// informersCheck checks caches of informers started on start. Informers started later on alerts of other kinds,
+// e.g. custom resources owners, are not checked: listing such a kind may be forbidden, and alerts about it
+// are forwarded with whatever data is loaded.
+func (server *Server) informersCheck() *HealthCheck {
+	if !server.Promicher.Kube.HasSynced() {
+		return &HealthCheck{Name: "kube-informers", OK: false, Message: "caches of informers started on start are not synced yet"}
+	}
+	return &HealthCheck{Name: "kube-informers", OK: true}
+}
+
+func (server *Server) checkDestinations() error {
+	destinations := server.Forwarder.ResolveDestinations()
+
+	errs := make([]error, len(destinations))
+	var wg sync.WaitGroup
+	for i, destination := range destinations {
+		wg.Add(1)
+		go func(i int, destination *Destination) {
+			defer wg.Done()
+			errs[i] = server.Forwarder.CheckDestination(destination)
+		}(i, destination)
+	}
+	wg.Wait()
+
+	reachable := 0
+	var failures []string
+	for i, err := range errs {
+		if err == nil {
+			reachable++
+		} else {
+			failures = append(failures, fmt.Sprintf("%s: %s", destinations[i], err))
+		}
+	}
+
+	if !server.Forwarder.Policy.IsSatisfied(reachable, len(destinations)) {
+		return fmt.Errorf("%d of %d destinations are reachable, '%s' policy is not satisfied: %v",
+			reachable, len(destinations), server.Forwarder.Policy, failures)
+	}
+
+	return nil
+}
+
+func runHealthCheck(name string, check func() error) *HealthCheck {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- check()
+	}()
+
+	var err error
+	select {
+	case err = <-errCh:
+	case <-time.After(HealthCheckTimeout):
+		err = fmt.Errorf("timeout after %s", HealthCheckTimeout)
+	}
+
+	if err != nil {
+		return &HealthCheck{Name: name, OK: false, Message: err.Error()}
+	}
+	return &HealthCheck{Name: name, OK: true}
+}
+
+func writeHealthReport(w http.ResponseWriter, report *HealthReport) {
+	report.Status = "ok"
+	for _, check := range report.Checks {
+		if !check.OK {
+			report.Status = "failed"
+			rlog.Debugf("Health check %s failed: %s", check.Name, check.Message)
+		}
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("Promicher internal server error: cannot dump health report: %s", err)))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status == "ok" {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(data)
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"fmt"
+	"github.com/flant/promicher/pkg/kube/fake"
+	"github.com/flant/promicher/pkg/promicher"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"testing"
+	"time"
+)
+
+func TestInformersCheckIgnoresInformersStartedOnAlerts(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	forbidden := errors.NewForbidden(schema.GroupResource{Group: "argoproj.io", Resource: "rollouts"}, "", fmt.Errorf("denied"))
+	kube, err := fake.NewKubeWithOptions(stopCh, fake.Options{Failures: []fake.Failure{{Verb: "list", Resource: "rollouts", Err: forbidden}}}, fake.NewCluster()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kube.SyncTimeout = 100 * time.Millisecond
+
+	// An alert about a pod owned by a rollout starts the rollouts informer, which never syncs
+	if _, err := kube.GetObject("", "Rollout", fake.ClusterNamespace, "web"); err == nil {
+		t.Fatalf("expected rollouts informer not synced")
+	}
+
+	server := &Server{Promicher: promicher.NewPromicher(kube, promicher.NewLRUAlertsCache(10, 0), &promicher.Config{})}
+	if check := server.informersCheck(); !check.OK {
+		t.Errorf("expected informers check ok, got %s", check.Message)
+	}
+}
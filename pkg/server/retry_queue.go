@@ -0,0 +1,359 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/romana/rlog"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetryItem is an alerts batch failed to be sent to a single destination.
+type RetryItem struct {
+	Id            string       `json:"id"`
+	Destination   *Destination `json:"destination"`
+	Method        string       `json:"method"`
+	Header        http.Header  `json:"header"`
+	Data          []byte       `json:"data"`
+	FirstFailedAt time.Time    `json:"firstFailedAt"`
+	Attempts      int          `json:"attempts"`
+	NextAttemptAt time.Time    `json:"nextAttemptAt"`
+}
+
+// MaxRetryBackoff caps the delay between retries when MaxBackoff is not set.
+const MaxRetryBackoff = time.Hour
+
+// RetryQueue resends failed alerts batches with exponential backoff.
+// Items older than MaxAge are dropped, the oldest items are dropped when the queue is full.
+// When Dir is set, every queued item is also stored on disk and loaded on start.
+// Items of service destinations are resent to the current endpoints of the service.
+type RetryQueue struct {
+	Forwarder      *Forwarder
+	MaxSize        int
+	MaxAge         time.Duration
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Dir            string
+
+	mutex  sync.Mutex
+	items  []*RetryItem
+	lastId int64
+
+	// Serializes retry passes, so the same item is never sent concurrently
+	retryMutex sync.Mutex
+}
+
+func NewRetryQueue(forwarder *Forwarder, maxSize int, maxAge, initialBackoff, maxBackoff time.Duration, dir string) (*RetryQueue, error) {
+	queue := &RetryQueue{
+		Forwarder:      forwarder,
+		MaxSize:        maxSize,
+		MaxAge:         maxAge,
+		InitialBackoff: initialBackoff,
+		MaxBackoff:     maxBackoff,
+		Dir:            dir,
+	}
+
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("cannot create retry queue dir %s: %s", dir, err)
+		}
+		if err := queue.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	return queue, nil
+}
+
+// Push queues the failed request for the first retry.
+func (queue *RetryQueue) Push(result *ForwardResult, method string, header http.Header) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	now := time.Now()
+	queue.lastId++
+
+	item := &RetryItem{
+		Id:            fmt.Sprintf("%d-%d", now.UnixNano(), queue.lastId),
+		Destination:   result.Destination,
+		Method:        method,
+		Header:        header.Clone(),
+		Data:          result.RequestData,
+		FirstFailedAt: now,
+		Attempts:      1,
+		NextAttemptAt: now.Add(queue.backoff(1)),
+	}
+
+	queue.dropOldest(queue.MaxSize - 1)
+
+	queue.items = append(queue.items, item)
+	queue.store(item)
+
+	rlog.Infof("Retry queue: alerts batch %s for %s queued, next attempt at %s", item.Id, item.Destination, item.NextAttemptAt.Format(time.RFC3339))
+}
+
+func (queue *RetryQueue) Len() int {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	return len(queue.items)
+}
+
+// Run retries due items every second until stopCh is closed.
+func (queue *RetryQueue) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			queue.RetryDue(time.Now())
+		}
+	}
+}
+
+// RetryDue resends all items with the next attempt time before now.
+func (queue *RetryQueue) RetryDue(now time.Time) {
+	queue.retryMutex.Lock()
+	defer queue.retryMutex.Unlock()
+
+	for _, item := range queue.dueItems(now) {
+		queue.retry(item, now)
+	}
+}
+
+// Flush resends all items at once regardless of their backoff until ctx is done.
+// Items failed again are kept in the queue and on disk if the queue is disk-backed.
+func (queue *RetryQueue) Flush(ctx context.Context) {
+	queue.retryMutex.Lock()
+	defer queue.retryMutex.Unlock()
+
+	queue.mutex.Lock()
+	items := make([]*RetryItem, len(queue.items))
+	copy(items, queue.items)
+	queue.mutex.Unlock()
+
+	if len(items) == 0 {
+		return
+	}
+
+	rlog.Infof("Retry queue: flushing %d alerts batches", len(items))
+
+	for _, item := range items {
+		if ctx.Err() != nil {
+			break
+		}
+		queue.retry(item, time.Now())
+	}
+
+	if left := queue.Len(); left > 0 {
+		rlog.Warnf("Retry queue: %d alerts batches are not flushed", left)
+	}
+}
+
+func (queue *RetryQueue) dueItems(now time.Time) []*RetryItem {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	var res []*RetryItem
+	for _, item := range queue.items {
+		if !item.NextAttemptAt.After(now) {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+func (queue *RetryQueue) retry(item *RetryItem, now time.Time) {
+	if queue.MaxAge > 0 && now.Sub(item.FirstFailedAt) > queue.MaxAge {
+		rlog.Warnf("Retry queue: dropping alerts batch %s for %s after %d attempts: older than %s", item.Id, item.Destination, item.Attempts, queue.MaxAge)
+		queue.mutex.Lock()
+		queue.remove(item)
+		queue.mutex.Unlock()
+		return
+	}
+
+	var result *ForwardResult
+	if destination, err := queue.resolveDestination(item); err != nil {
+		result = &ForwardResult{Destination: item.Destination, RequestData: item.Data, Err: err}
+	} else {
+		result = queue.Forwarder.SendData(destination, item.Method, item.Header, item.Data)
+	}
+
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	// Item may be dropped from the full queue while being sent
+	if !queue.contains(item) {
+		return
+	}
+
+	if result.IsSuccess() {
+		rlog.Infof("Retry queue: alerts batch %s for %s sent after %d attempts", item.Id, item.Destination, item.Attempts)
+		queue.remove(item)
+		return
+	}
+
+	if !result.IsRetryable() {
+		rlog.Errorf("Retry queue: dropping alerts batch %s: %s", item.Id, result)
+		queue.remove(item)
+		return
+	}
+
+	item.Destination = result.Destination
+	item.Attempts++
+	item.NextAttemptAt = now.Add(queue.backoff(item.Attempts))
+	queue.store(item)
+
+	rlog.Warnf("Retry queue: attempt %d of alerts batch %s failed: %s, next attempt at %s", item.Attempts-1, item.Id, result, item.NextAttemptAt.Format(time.RFC3339))
+}
+
+// resolveDestination returns the destination to resend the item to. The endpoint of a service destination
+// may be gone after a rollout, or the service had no ready endpoints at all,
+// then the item is sent to another ready endpoint of the service.
+func (queue *RetryQueue) resolveDestination(item *RetryItem) (*Destination, error) {
+	service := item.Destination.Service
+	if service == nil {
+		return item.Destination, nil
+	}
+
+	destinations, err := service.Resolve(queue.Forwarder.Kube)
+	if err != nil {
+		return nil, err
+	}
+	for _, destination := range destinations {
+		if destination.URL == item.Destination.URL {
+			return destination, nil
+		}
+	}
+	if len(destinations) == 0 {
+		return nil, fmt.Errorf("destination %s has no ready endpoints", service)
+	}
+
+	if item.Destination.URL != "" {
+		rlog.Infof("Retry queue: %s is not an endpoint of %s anymore, sending alerts batch %s to %s", item.Destination.URL, service, item.Id, destinations[0])
+	}
+	return destinations[0], nil
+}
+
+// backoff returns the delay before the next attempt: InitialBackoff doubled on each attempt
+// up to MaxBackoff, or MaxRetryBackoff when MaxBackoff is not set.
+func (queue *RetryQueue) backoff(attempts int) time.Duration {
+	maxBackoff := queue.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = MaxRetryBackoff
+	}
+
+	delay := queue.InitialBackoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		return maxBackoff
+	}
+	return delay
+}
+
+// dropOldest drops the oldest items until the full queue has at most size items.
+func (queue *RetryQueue) dropOldest(size int) {
+	for queue.MaxSize > 0 && len(queue.items) > size {
+		rlog.Warnf("Retry queue is full: dropping alerts batch %s for %s", queue.items[0].Id, queue.items[0].Destination)
+		queue.remove(queue.items[0])
+	}
+}
+
+func (queue *RetryQueue) contains(item *RetryItem) bool {
+	for _, queuedItem := range queue.items {
+		if queuedItem == item {
+			return true
+		}
+	}
+	return false
+}
+
+func (queue *RetryQueue) remove(item *RetryItem) {
+	for i := range queue.items {
+		if queue.items[i] == item {
+			queue.items = append(queue.items[:i], queue.items[i+1:]...)
+			break
+		}
+	}
+
+	if queue.Dir != "" {
+		if err := os.Remove(queue.itemPath(item)); err != nil && !os.IsNotExist(err) {
+			rlog.Errorf("Retry queue: cannot remove %s: %s", queue.itemPath(item), err)
+		}
+	}
+}
+
+func (queue *RetryQueue) itemPath(item *RetryItem) string {
+	return filepath.Join(queue.Dir, fmt.Sprintf("%s.json", item.Id))
+}
+
+func (queue *RetryQueue) store(item *RetryItem) {
+	if queue.Dir == "" {
+		return
+	}
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		rlog.Errorf("Retry queue: cannot dump alerts batch %s: %s", item.Id, err)
+		return
+	}
+
+	// Write to temporary file first, so a crash will not leave a broken item.
+	// Items contain request headers, e.g. Authorization, so they are readable by the owner only.
+	tmpPath := queue.itemPath(item) + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		rlog.Errorf("Retry queue: cannot write %s: %s", tmpPath, err)
+		return
+	}
+	if err := os.Rename(tmpPath, queue.itemPath(item)); err != nil {
+		rlog.Errorf("Retry queue: cannot rename %s: %s", tmpPath, err)
+	}
+}
+
+func (queue *RetryQueue) load() error {
+	files, err := ioutil.ReadDir(queue.Dir)
+	if err != nil {
+		return fmt.Errorf("cannot read retry queue dir %s: %s", queue.Dir, err)
+	}
+
+	// Files are sorted by name, which starts with the creation timestamp
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		path := filepath.Join(queue.Dir, file.Name())
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("cannot read retry queue item %s: %s", path, err)
+		}
+
+		item := &RetryItem{}
+		if err := json.Unmarshal(data, item); err != nil {
+			rlog.Errorf("Retry queue: ignoring broken item %s: %s", path, err)
+			continue
+		}
+
+		queue.items = append(queue.items, item)
+	}
+
+	queue.dropOldest(queue.MaxSize)
+
+	if len(queue.items) > 0 {
+		rlog.Infof("Retry queue: loaded %d alerts batches from %s", len(queue.items), queue.Dir)
+	}
+
+	return nil
+}
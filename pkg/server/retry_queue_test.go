@@ -0,0 +1,249 @@
+package server
+
+import (
+	"github.com/flant/promicher/pkg/kube/fake"
+	"github.com/flant/promicher/pkg/promicher"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestAlertmanager serves alerts API requests with the status codes in turn, the last one is repeated.
+func newTestAlertmanager(t *testing.T, statusCodes ...int) (*httptest.Server, *int32) {
+	t.Helper()
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := int(atomic.AddInt32(&requests, 1)) - 1
+		if i >= len(statusCodes) {
+			i = len(statusCodes) - 1
+		}
+		w.WriteHeader(statusCodes[i])
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requests
+}
+
+func newTestRetryQueue(t *testing.T, maxSize int, dir string) *RetryQueue {
+	t.Helper()
+
+	forwarder := NewForwarder(nil, nil, PolicyAny, time.Second, nil)
+	queue, err := NewRetryQueue(forwarder, maxSize, time.Hour, time.Second, time.Minute, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queue
+}
+
+func failedResult(url string, data string) *ForwardResult {
+	return &ForwardResult{
+		Destination: &Destination{URL: url, APIVersion: promicher.APIv1},
+		RequestData: []byte(data),
+		StatusCode:  http.StatusServiceUnavailable,
+	}
+}
+
+func TestRetryQueueBackoff(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxBackoff time.Duration
+		attempts   int
+		expected   time.Duration
+	}{
+		{"first attempt", time.Minute, 1, time.Second},
+		{"doubled", time.Minute, 3, 4 * time.Second},
+		{"max backoff", time.Minute, 10, time.Minute},
+		{"many attempts", time.Minute, 1000, time.Minute},
+		{"no max backoff", 0, 1000, MaxRetryBackoff},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queue := &RetryQueue{InitialBackoff: time.Second, MaxBackoff: test.maxBackoff}
+			if delay := queue.backoff(test.attempts); delay != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, delay)
+			}
+		})
+	}
+}
+
+func TestRetryQueueRetryDue(t *testing.T) {
+	alertmanager, requests := newTestAlertmanager(t, http.StatusServiceUnavailable, http.StatusOK)
+	queue := newTestRetryQueue(t, 10, "")
+
+	now := time.Now()
+	queue.Push(failedResult(alertmanager.URL, "[]"), http.MethodPost, http.Header{})
+
+	queue.RetryDue(now)
+	if atomic.LoadInt32(requests) != 0 {
+		t.Fatalf("expected no attempts before the backoff, got %d", atomic.LoadInt32(requests))
+	}
+
+	queue.RetryDue(now.Add(2 * time.Second))
+	if queue.Len() != 1 || queue.items[0].Attempts != 2 {
+		t.Fatalf("expected the failed item to stay in the queue after 2 attempts, got %d items", queue.Len())
+	}
+
+	queue.RetryDue(now.Add(time.Minute))
+	if queue.Len() != 0 {
+		t.Errorf("expected the sent item to be removed, got %d items", queue.Len())
+	}
+	if atomic.LoadInt32(requests) != 2 {
+		t.Errorf("expected 2 requests, got %d", atomic.LoadInt32(requests))
+	}
+}
+
+func TestRetryQueueMaxAge(t *testing.T) {
+	alertmanager, requests := newTestAlertmanager(t, http.StatusOK)
+	queue := newTestRetryQueue(t, 10, "")
+
+	queue.Push(failedResult(alertmanager.URL, "[]"), http.MethodPost, http.Header{})
+	queue.RetryDue(time.Now().Add(queue.MaxAge + time.Minute))
+
+	if queue.Len() != 0 {
+		t.Errorf("expected the expired item to be dropped, got %d items", queue.Len())
+	}
+	if atomic.LoadInt32(requests) != 0 {
+		t.Errorf("expected the expired item not to be sent, got %d requests", atomic.LoadInt32(requests))
+	}
+}
+
+func TestRetryQueueMaxSize(t *testing.T) {
+	queue := newTestRetryQueue(t, 2, "")
+
+	for _, data := range []string{"first", "second", "third"} {
+		queue.Push(failedResult("http://alertmanager/api/v1/alerts", data), http.MethodPost, http.Header{})
+	}
+
+	if queue.Len() != 2 {
+		t.Fatalf("expected 2 items, got %d", queue.Len())
+	}
+	if data := string(queue.items[0].Data); data != "second" {
+		t.Errorf("expected the oldest item to be dropped, the first item is '%s'", data)
+	}
+}
+
+func TestRetryQueueDisk(t *testing.T) {
+	dir := t.TempDir()
+	queue := newTestRetryQueue(t, 10, dir)
+
+	header := http.Header{"Authorization": []string{"Bearer secret"}}
+	for _, data := range []string{"first", "second", "third"} {
+		queue.Push(failedResult("http://alertmanager/api/v1/alerts", data), http.MethodPost, header)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(files) != 3 {
+		t.Fatalf("expected 3 item files, got %v, error %v", files, err)
+	}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != 0600 {
+			t.Errorf("expected %s mode 0600, got %o", file, perm)
+		}
+	}
+
+	// The queue is loaded with a smaller size limit
+	loaded := newTestRetryQueue(t, 2, dir)
+	if loaded.Len() != 2 {
+		t.Fatalf("expected 2 loaded items, got %d", loaded.Len())
+	}
+	if data := string(loaded.items[0].Data); data != "second" {
+		t.Errorf("expected the oldest item to be dropped on load, the first item is '%s'", data)
+	}
+	if auth := loaded.items[1].Header.Get("Authorization"); auth != "Bearer secret" {
+		t.Errorf("expected the request header to be loaded, got '%s'", auth)
+	}
+
+	files, err = filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(files) != 2 {
+		t.Errorf("expected the dropped item file to be removed, got %v, error %v", files, err)
+	}
+}
+
+// testServerAddress returns the IP and the port the test server listens on.
+func testServerAddress(t *testing.T, server *httptest.Server) (string, int32) {
+	t.Helper()
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, portString, err := net.SplitHostPort(serverURL.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, int32(port)
+}
+
+func TestRetryQueueResolvesServiceDestination(t *testing.T) {
+	alertmanager, requests := newTestAlertmanager(t, http.StatusOK)
+
+	// After a rollout the service has the only endpoint, which is the test alertmanager
+	ip, port := testServerAddress(t, alertmanager)
+	queue := newTestRetryQueue(t, 10, "")
+	queue.Forwarder.Kube = newTestServiceKube(t, ip, port)
+
+	service := &ServiceDestination{Namespace: "monitoring", Name: "alertmanager", Port: "web", APIVersion: promicher.APIv1}
+	result := failedResult("http://10.0.0.9:9093/api/v1/alerts", "[]")
+	result.Destination.Service = service
+	queue.Push(result, http.MethodPost, http.Header{})
+
+	queue.RetryDue(time.Now().Add(time.Minute))
+
+	if queue.Len() != 0 || atomic.LoadInt32(requests) != 1 {
+		t.Errorf("expected the item to be sent to the current service endpoint, got %d items, %d requests", queue.Len(), atomic.LoadInt32(requests))
+	}
+}
+
+func TestRetryQueueServiceDestinationWithoutEndpoints(t *testing.T) {
+	alertmanager, requests := newTestAlertmanager(t, http.StatusOK)
+
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	serviceKube, err := fake.NewKube(stopCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue := newTestRetryQueue(t, 10, "")
+	queue.Forwarder.Kube = serviceKube
+	queue.Forwarder.ServiceDestinations = []*ServiceDestination{
+		{Namespace: "monitoring", Name: "alertmanager", Port: "web", APIVersion: promicher.APIv1},
+	}
+
+	// Alertmanager pods restart, the service has no endpoints
+	results := queue.Forwarder.Forward(http.MethodPost, http.Header{}, []promicher.Alert{{Labels: map[string]string{"alertname": "Test"}}})
+	if len(results) != 1 || results[0].IsSuccess() || !results[0].IsRetryable() {
+		t.Fatalf("expected a retryable failed result of the service destination, got %v", results)
+	}
+	queue.Push(results[0], http.MethodPost, http.Header{})
+
+	queue.RetryDue(time.Now().Add(time.Minute))
+	if queue.Len() != 1 || atomic.LoadInt32(requests) != 0 {
+		t.Fatalf("expected the item to stay in the queue while the service has no endpoints, got %d items", queue.Len())
+	}
+
+	ip, port := testServerAddress(t, alertmanager)
+	addTestServiceEndpoint(t, serviceKube, ip, port)
+
+	queue.RetryDue(time.Now().Add(10 * time.Minute))
+	if queue.Len() != 0 || atomic.LoadInt32(requests) != 1 {
+		t.Errorf("expected the item to be sent to the ready service endpoint, got %d items, %d requests", queue.Len(), atomic.LoadInt32(requests))
+	}
+}
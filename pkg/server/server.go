@@ -1,39 +1,109 @@
 package server
 
 import (
-	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"github.com/flant/promicher/pkg/metrics"
 	"github.com/flant/promicher/pkg/promicher"
 	"github.com/romana/rlog"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 type Server struct {
-	ListenHost     string
-	DestinationURL string
-	Promicher      *promicher.Promicher
+	ListenHost string
+	Forwarder  *Forwarder
+	RetryQueue *RetryQueue
+	Promicher  *promicher.Promicher
+
+	httpServer   *http.Server
+	shuttingDown int32
 }
 
-func NewServer(listenHost, destinationURL string, promicher *promicher.Promicher) *Server {
-	return &Server{
-		Promicher:      promicher,
-		ListenHost:     listenHost,
-		DestinationURL: destinationURL,
+// NewServer creates the server, retryQueue may be nil to disable retries of failed forwards.
+func NewServer(listenHost string, forwarder *Forwarder, retryQueue *RetryQueue, promicher *promicher.Promicher) *Server {
+	server := &Server{
+		Promicher:  promicher,
+		ListenHost: listenHost,
+		Forwarder:  forwarder,
+		RetryQueue: retryQueue,
 	}
+
+	server.httpServer = &http.Server{Addr: listenHost, Handler: server.Handler()}
+
+	return server
 }
 
+func (server *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", server.HandleLive)
+	mux.HandleFunc("/readyz", server.HandleReady)
+	// Backward compatible readiness probe
+	mux.HandleFunc("/healthz", server.HandleReady)
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc(promicher.APIv1.AlertsPath(), server.HandleAlertsV1)
+	mux.HandleFunc(promicher.APIv2.AlertsPath(), server.HandleAlertsV2)
+	mux.HandleFunc("/api/v1/explain", server.HandleExplain)
+	return mux
+}
+
+// Run serves requests until Shutdown.
 func (server *Server) Run() error {
-	http.HandleFunc("/healthz", server.HandleHealth)
-	http.HandleFunc("/api/v1/alerts", server.HandleAlerts)
-	return http.ListenAndServe(server.ListenHost, nil)
+	err := server.httpServer.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
 }
 
-func (server *Server) HandleHealth(w http.ResponseWriter, _ *http.Request) {
-	w.WriteHeader(http.StatusOK)
+// Shutdown reports not ready at once, waits for the delay for kubernetes to stop routing requests,
+// then stops accepting connections and waits for in-flight requests to finish until ctx is done.
+func (server *Server) Shutdown(ctx context.Context, delay time.Duration) error {
+	atomic.StoreInt32(&server.shuttingDown, 1)
+
+	if delay > 0 {
+		rlog.Infof("Server: not ready, waiting %s before shutdown", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+	}
+
+	rlog.Info("Server: draining in-flight requests")
+
+	return server.httpServer.Shutdown(ctx)
 }
 
-func (server *Server) HandleAlerts(w http.ResponseWriter, r *http.Request) {
+func (server *Server) HandleAlertsV1(w http.ResponseWriter, r *http.Request) {
+	server.HandleAlerts(w, r, promicher.APIv1)
+}
+
+func (server *Server) HandleAlertsV2(w http.ResponseWriter, r *http.Request) {
+	server.HandleAlerts(w, r, promicher.APIv2)
+}
+
+// statusRecorder remembers the response code for metrics.
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (recorder *statusRecorder) WriteHeader(statusCode int) {
+	recorder.statusCode = statusCode
+	recorder.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (server *Server) HandleAlerts(w http.ResponseWriter, r *http.Request, version promicher.APIVersion) {
+	recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+	defer func() {
+		metrics.Requests.WithLabelValues(string(version), strconv.Itoa(recorder.statusCode)).Inc()
+	}()
+	w = recorder
+
 	dataBytes, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -43,49 +113,95 @@ func (server *Server) HandleAlerts(w http.ResponseWriter, r *http.Request) {
 
 	rlog.Debugf("Received request %s, body:\n%s", r.URL.Path, dataBytes)
 
-	client := &http.Client{}
-
-	proxyRequest, err := http.NewRequest(r.Method, server.DestinationURL, nil)
+	alerts, err := promicher.ParseAlerts(dataBytes, version)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("Promicher internal server error: %s", err)))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Promicher cannot parse API %s alerts: %s", version, err)))
 		return
 	}
-	for k, v := range r.Header {
-		proxyRequest.Header[k] = v
-	}
 
-	newDataBytes, err := server.Promicher.ProcessData(dataBytes)
+	metrics.AlertsReceived.WithLabelValues(string(version)).Add(float64(len(alerts)))
+
+	newAlerts, _, err := server.Promicher.ProcessAlerts(alerts)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(fmt.Sprintf("Promicher internal server error: cannot enrich request data: %s", err)))
 		return
 	}
 
-	rlog.Debugf("Request %s, enriched body:\n%s", r.URL.Path, newDataBytes)
-	proxyRequest.Body = ioutil.NopCloser(bytes.NewReader(newDataBytes))
+	results := server.Forwarder.Forward(r.Method, r.Header, newAlerts)
+
+	var succeeded []*ForwardResult
+	for _, result := range results {
+		if result.IsSuccess() {
+			succeeded = append(succeeded, result)
+		} else {
+			rlog.Errorf("Request %s forwarding failed: %s", r.URL.Path, result)
 
-	rlog.Debugf("Proxying to %s", server.DestinationURL)
+			if server.RetryQueue != nil && result.IsRetryable() {
+				server.RetryQueue.Push(result, r.Method, r.Header)
+			}
+		}
+	}
 
-	response, err := client.Do(proxyRequest)
+	if !server.Forwarder.Policy.IsSatisfied(len(succeeded), len(results)) {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(fmt.Sprintf("Promicher cannot forward alerts: %d of %d destinations succeeded, '%s' policy is not satisfied:\n%s",
+			len(succeeded), len(results), server.Forwarder.Policy, server.Forwarder.Summary(results))))
+		return
+	}
+
+	response := succeeded[0]
+	for k, v := range response.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(response.StatusCode)
+	w.Write(response.Body)
+}
+
+// HandleExplain enriches alerts without forwarding and responds with explanations of the enrichment.
+// Alerts may be in the API v1 or v2 format.
+func (server *Server) HandleExplain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Promicher explain accepts POST requests only"))
+		return
+	}
+
+	dataBytes, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("Promicher internal server error: %s", err)))
+		w.Write([]byte(fmt.Sprintf("Promicher internal server error: cannot read request data: %s", err)))
 		return
 	}
 
-	dataBytes, err = ioutil.ReadAll(response.Body)
+	// API v2 format is a superset of v1, which only requires startsAt and endsAt
+	alerts, err := promicher.ParseAlerts(dataBytes, promicher.APIv2)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("Promicher internal server error: error reading response from proxy destination %s: %s", server.DestinationURL, err)))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Promicher cannot parse alerts: %s", err)))
 		return
 	}
 
-	rlog.Debugf("Received response from %s: %s\n%s", server.DestinationURL, response.Status, string(dataBytes))
+	explanations := make([]*promicher.AlertExplanation, 0, len(alerts))
+	for _, alert := range alerts {
+		explanation, err := server.Promicher.ExplainAlert(alert)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf("Promicher internal server error: %s", err)))
+			return
+		}
+		explanations = append(explanations, explanation)
+	}
 
-	for k, v := range response.Header {
-		w.Header()[k] = v
+	res, err := json.MarshalIndent(explanations, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("Promicher internal server error: cannot dump explanations: %s", err)))
+		return
 	}
-	w.WriteHeader(response.StatusCode)
-	w.Write(dataBytes)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(res)
 }